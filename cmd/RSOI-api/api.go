@@ -1,35 +1,91 @@
 package main
 
 import (
+	"context"
+
 	api "github.com/andreymgn/RSOI-api/pkg/api"
+	"github.com/andreymgn/RSOI-api/pkg/config"
 	category "github.com/andreymgn/RSOI-category/pkg/category/proto"
 	comment "github.com/andreymgn/RSOI-comment/pkg/comment/proto"
 	post "github.com/andreymgn/RSOI-post/pkg/post/proto"
 	poststats "github.com/andreymgn/RSOI-poststats/pkg/poststats/proto"
 	user "github.com/andreymgn/RSOI-user/pkg/user/proto"
 	"github.com/andreymgn/RSOI/pkg/tracer"
+	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/grpc-ecosystem/grpc-opentracing/go/otgrpc"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
 )
 
-func runAPI(port int, postAddr, categoryAddr, commentAddr, postStatsAddr, userAddr, jaegerAddr string) error {
-	tracer, closer, err := tracer.NewTracer("api", jaegerAddr)
+// chainUnaryClient returns interceptor which calls interceptors in order,
+// the first one being the outermost
+func chainUnaryClient(interceptors ...grpc.UnaryClientInterceptor) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		chained := invoker
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], chained
+			chained = func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				return interceptor(ctx, method, req, reply, cc, next, opts...)
+			}
+		}
+
+		return chained(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// dial connects to backend b guarded by breaker, TLS files of b are reloaded
+// until ctx is done
+func dial(ctx context.Context, b config.Backend, breaker *api.Breaker, interceptors []grpc.UnaryClientInterceptor) (*grpc.ClientConn, error) {
+	transport := grpc.WithInsecure()
+	if !b.TLS.Disabled {
+		creds, err := api.NewBackendCredentials(api.BackendTLSConfig{
+			CAFile:     b.TLS.CAFile,
+			CertFile:   b.TLS.CertFile,
+			KeyFile:    b.TLS.KeyFile,
+			ServerName: b.TLS.ServerName,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		go creds.Watch(ctx)
+		transport = grpc.WithTransportCredentials(creds)
+	}
+
+	chain := append([]grpc.UnaryClientInterceptor{}, interceptors...)
+	chain = append(chain, breaker.Interceptor())
+	return grpc.Dial(b.Addr,
+		transport,
+		grpc.WithUnaryInterceptor(chainUnaryClient(chain...)),
+	)
+}
+
+func backendOptions(b config.Backend, breaker *api.Breaker) api.BackendOptions {
+	return api.BackendOptions{Optional: b.Optional, HealthCheck: b.HealthCheck, Breaker: breaker}
+}
+
+func runAPI(conf config.Config) error {
+	tracer, closer, err := tracer.NewTracer("api", conf.JaegerAddr)
 	if err != nil {
 		return err
 	}
 
 	defer closer.Close()
 
-	creds, err := credentials.NewClientTLSFromFile("/post-cert.pem", "")
-	if err != nil {
-		return err
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientMetrics := grpc_prometheus.NewClientMetrics()
+	clientMetrics.EnableClientHandlingTimeHistogram()
+	interceptors := []grpc.UnaryClientInterceptor{
+		otgrpc.OpenTracingClientInterceptor(tracer),
+		api.RequestIDInterceptor(),
+		api.RetryInterceptor(conf.RPC),
+		api.DeadlineInterceptor(conf.RPC),
+		clientMetrics.UnaryClientInterceptor(),
 	}
 
-	postConn, err := grpc.Dial(postAddr,
-		grpc.WithTransportCredentials(creds),
-		grpc.WithUnaryInterceptor(otgrpc.OpenTracingClientInterceptor(tracer)),
-	)
+	postBreaker := api.NewBreaker("post", conf.Breaker)
+	postConn, err := dial(ctx, conf.Post, postBreaker, interceptors)
 	if err != nil {
 		return err
 	}
@@ -37,15 +93,8 @@ func runAPI(port int, postAddr, categoryAddr, commentAddr, postStatsAddr, userAd
 	defer postConn.Close()
 	pc := post.NewPostClient(postConn)
 
-	creds, err = credentials.NewClientTLSFromFile("/category-cert.pem", "")
-	if err != nil {
-		return err
-	}
-
-	categoryConn, err := grpc.Dial(categoryAddr,
-		grpc.WithTransportCredentials(creds),
-		grpc.WithUnaryInterceptor(otgrpc.OpenTracingClientInterceptor(tracer)),
-	)
+	categoryBreaker := api.NewBreaker("category", conf.Breaker)
+	categoryConn, err := dial(ctx, conf.Category, categoryBreaker, interceptors)
 	if err != nil {
 		return err
 	}
@@ -53,15 +102,8 @@ func runAPI(port int, postAddr, categoryAddr, commentAddr, postStatsAddr, userAd
 	defer categoryConn.Close()
 	catc := category.NewCategoryClient(categoryConn)
 
-	creds, err = credentials.NewClientTLSFromFile("/comment-cert.pem", "")
-	if err != nil {
-		return err
-	}
-
-	commentConn, err := grpc.Dial(commentAddr,
-		grpc.WithTransportCredentials(creds),
-		grpc.WithUnaryInterceptor(otgrpc.OpenTracingClientInterceptor(tracer)),
-	)
+	commentBreaker := api.NewBreaker("comment", conf.Breaker)
+	commentConn, err := dial(ctx, conf.Comment, commentBreaker, interceptors)
 	if err != nil {
 		return err
 	}
@@ -69,15 +111,8 @@ func runAPI(port int, postAddr, categoryAddr, commentAddr, postStatsAddr, userAd
 	defer commentConn.Close()
 	cc := comment.NewCommentClient(commentConn)
 
-	creds, err = credentials.NewClientTLSFromFile("/poststats-cert.pem", "")
-	if err != nil {
-		return err
-	}
-
-	postStatsConn, err := grpc.Dial(postStatsAddr,
-		grpc.WithTransportCredentials(creds),
-		grpc.WithUnaryInterceptor(otgrpc.OpenTracingClientInterceptor(tracer)),
-	)
+	postStatsBreaker := api.NewBreaker("poststats", conf.Breaker)
+	postStatsConn, err := dial(ctx, conf.PostStats, postStatsBreaker, interceptors)
 	if err != nil {
 		return err
 	}
@@ -85,24 +120,29 @@ func runAPI(port int, postAddr, categoryAddr, commentAddr, postStatsAddr, userAd
 	defer postStatsConn.Close()
 	psc := poststats.NewPostStatsClient(postStatsConn)
 
-	creds, err = credentials.NewClientTLSFromFile("/user-cert.pem", "")
+	userBreaker := api.NewBreaker("user", conf.Breaker)
+	userConn, err := dial(ctx, conf.User, userBreaker, interceptors)
 	if err != nil {
 		return err
 	}
 
-	userConn, err := grpc.Dial(userAddr,
-		grpc.WithTransportCredentials(creds),
-		grpc.WithUnaryInterceptor(otgrpc.OpenTracingClientInterceptor(tracer)),
-	)
+	defer userConn.Close()
+	uc := user.NewUserClient(userConn)
+
+	server, err := api.NewServer(pc, catc, cc, psc, uc, tracer, conf.HTTP, conf.Workers)
 	if err != nil {
 		return err
 	}
 
-	defer userConn.Close()
-	uc := user.NewUserClient(userConn)
+	if err := server.RegisterMetrics(clientMetrics); err != nil {
+		return err
+	}
 
-	server := api.NewServer(pc, catc, cc, psc, uc, tracer)
-	server.Start(port)
+	server.AddBackend("post", postConn, backendOptions(conf.Post, postBreaker))
+	server.AddBackend("category", categoryConn, backendOptions(conf.Category, categoryBreaker))
+	server.AddBackend("comment", commentConn, backendOptions(conf.Comment, commentBreaker))
+	server.AddBackend("poststats", postStatsConn, backendOptions(conf.PostStats, postStatsBreaker))
+	server.AddBackend("user", userConn, backendOptions(conf.User, userBreaker))
 
-	return nil
+	return server.Start()
 }
@@ -1,29 +1,49 @@
 package main
 
 import (
-	"log"
+	"flag"
+	"math/rand"
 	"os"
-	"strconv"
+	"time"
+
+	"github.com/andreymgn/RSOI-api/pkg/config"
+	log "github.com/sirupsen/logrus"
 )
 
-func main() {
-	port, err := strconv.Atoi(os.Getenv("PORT"))
+func configureLogging(conf config.Log) {
+	level, err := log.ParseLevel(conf.Level)
 	if err != nil {
-		log.Println("PORT parse error")
+		level = log.InfoLevel
+	}
+	log.SetLevel(level)
+
+	if conf.Format == "text" {
+		log.SetFormatter(&log.TextFormatter{})
+	} else {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
+}
+
+func main() {
+	rand.Seed(time.Now().UnixNano())
+
+	conf, err := config.Load(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
 		return
 	}
 
-	postServerAddr := os.Getenv("POST-ADDR")
-	categoryServerAddr := os.Getenv("CATEGORY-ADDR")
-	commentServerAddr := os.Getenv("COMMENT-ADDR")
-	postStatsServerAddr := os.Getenv("POSTSTATS-ADDR")
-	userServerAddr := os.Getenv("USER-ADDR")
-	jaegerAddr := os.Getenv("JAEGER-ADDR")
+	if err != nil {
+		log.Println(err)
+		os.Exit(2)
+	}
+
+	configureLogging(conf.Log)
 
-	log.Printf("running API service on port %d\n", port)
-	err = runAPI(port, postServerAddr, categoryServerAddr, commentServerAddr, postStatsServerAddr, userServerAddr, jaegerAddr)
+	log.WithField("addr", conf.HTTP.Addr).Info("running API service")
+	err = runAPI(conf)
 
 	if err != nil {
-		log.Printf("finished with error %v", err)
+		log.WithError(err).Error("finished with error")
+		os.Exit(1)
 	}
 }
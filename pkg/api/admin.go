@@ -0,0 +1,161 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func (s *Server) getJobs() http.HandlerFunc {
+	type job struct {
+		ID          string
+		Queue       string
+		UID         string
+		CascadeID   string
+		RequestID   string
+		State       string
+		Attempts    int
+		LastError   string
+		NextAttempt *time.Time `json:",omitempty"`
+	}
+
+	type response struct {
+		Jobs []job
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		stateFilter, queueFilter := r.URL.Query().Get("state"), r.URL.Query().Get("queue")
+		switch stateFilter {
+		case "", jobStateQueued, jobStateInFlight, jobStateDead:
+		default:
+			writeError(w, r, http.StatusBadRequest, "unknown value of query parameter `state`")
+			return
+		}
+
+		jobs := make([]job, 0)
+		add := func(req workerRequest, state string) {
+			if stateFilter != "" && stateFilter != state {
+				return
+			}
+
+			if queueFilter != "" && queueFilter != req.queue {
+				return
+			}
+
+			j := job{req.id, req.queue, req.uid, req.cascadeID, req.requestID, state, req.attempts, req.lastError, nil}
+			if state == jobStateQueued {
+				nextAttempt := req.doneTime
+				j.NextAttempt = &nextAttempt
+			}
+			jobs = append(jobs, j)
+		}
+
+		for _, name := range queueNames {
+			queued, inFlight := s.queues[name].list()
+			for _, req := range inFlight {
+				add(req, jobStateInFlight)
+			}
+
+			sort.Slice(queued, func(i, j int) bool { return queued[i].doneTime.Before(queued[j].doneTime) })
+			for _, req := range queued {
+				add(req, jobStateQueued)
+			}
+		}
+
+		for _, req := range s.outbox.deadLetters() {
+			add(req, jobStateDead)
+		}
+
+		resp := response{jobs}
+		json, err := json.Marshal(resp)
+		if err != nil {
+			handleRPCError(w, r, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write(json)
+	}
+}
+
+func (s *Server) replayJob() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		// A dead letter gets a fresh set of attempts
+		if req, ok := s.outbox.deadLetter(id); ok {
+			q, ok := s.queues[req.queue]
+			if !ok {
+				writeError(w, r, http.StatusConflict, "job belongs to unknown queue")
+				return
+			}
+
+			req.attempts = 0
+			req.lastError = ""
+			req.doneTime = time.Now()
+			if err := s.outbox.add(req); err != nil {
+				handleRPCError(w, r, err)
+				return
+			}
+
+			q.push(req)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		// A job waiting for its next attempt is run right away
+		for _, q := range s.queues {
+			if req, ok := q.remove(id); ok {
+				req.doneTime = time.Now()
+				q.push(req)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			if q.isInFlight(id) {
+				writeError(w, r, http.StatusConflict, "job is in flight")
+				return
+			}
+		}
+
+		writeError(w, r, http.StatusNotFound, "")
+	}
+}
+
+func (s *Server) deleteJob() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		for _, q := range s.queues {
+			if q.isInFlight(id) {
+				writeError(w, r, http.StatusConflict, "job is in flight")
+				return
+			}
+		}
+
+		if _, ok := s.outbox.job(id); !ok {
+			writeError(w, r, http.StatusNotFound, "")
+			return
+		}
+
+		// The job stays queued if it can't be discarded, so that it isn't
+		// lost until the next restart
+		if err := s.finishJob(id, jobStateDiscarded); err != nil {
+			handleRPCError(w, r, err)
+			return
+		}
+
+		for _, q := range s.queues {
+			if _, ok := q.remove(id); ok {
+				break
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,272 @@
+package api
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	user "github.com/andreymgn/RSOI-user/pkg/user/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AuthConfig controls authentication of requests
+type AuthConfig struct {
+	// CacheSize is the maximum number of cached tokens, zero disables the
+	// cache
+	CacheSize int
+	// CacheTTL is how long a token is trusted without asking the user
+	// service, it bounds how late revocation made elsewhere is noticed
+	CacheTTL time.Duration
+	// PolicyCacheTTL is how long owners of resources looked up for
+	// authorization are kept, CacheSize bounds their number too
+	PolicyCacheTTL time.Duration
+	// AccessTokenTTL is lifetime of opaque access tokens issued by the user
+	// service, it is reported to OAuth clients as expires_in
+	AccessTokenTTL time.Duration
+	// JWT enables local verification of signed tokens
+	JWT JWTConfig
+}
+
+// DefaultAuthConfig returns AuthConfig with sensible defaults
+func DefaultAuthConfig() AuthConfig {
+	return AuthConfig{
+		CacheSize:      10000,
+		CacheTTL:       time.Minute,
+		PolicyCacheTTL: time.Minute * 5,
+		AccessTokenTTL: time.Hour,
+		JWT: JWTConfig{
+			JWKSRefresh: time.Minute * 10,
+			ClockSkew:   time.Second * 30,
+		},
+	}
+}
+
+// Principal is the authenticated caller
+type Principal struct {
+	UID   string
+	Admin bool
+	// AppID is the OAuth application the token was issued to, empty for
+	// tokens issued to the user directly and for opaque tokens, which
+	// don't say whom they were issued to
+	AppID  string
+	Scopes []string
+}
+
+// withPrincipal returns ctx carrying p, lines logged for it name the user
+func withPrincipal(ctx context.Context, p *Principal) context.Context {
+	ctx = context.WithValue(ctx, loggerKey, logger(ctx).WithField("uid", p.UID))
+	return context.WithValue(ctx, principalKey, p)
+}
+
+// principalFrom returns caller of the request, it is nil for anonymous
+// requests
+func principalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey).(*Principal)
+	return p
+}
+
+type tokenEntry struct {
+	token     string
+	principal *Principal
+	expires   time.Time
+}
+
+// tokenCache is a bounded cache of resolved tokens, the least recently used
+// ones are evicted first
+type tokenCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+func newTokenCache(c AuthConfig) *tokenCache {
+	return &tokenCache{size: c.CacheSize, ttl: c.CacheTTL, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func (c *tokenCache) get(token string) (*Principal, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[token]
+	if !ok {
+		return nil, false
+	}
+
+	entry := e.Value.(*tokenEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(e)
+		delete(c.entries, token)
+		return nil, false
+	}
+
+	c.order.MoveToFront(e)
+	return entry.principal, true
+}
+
+// add caches p for token for the configured TTL or until expires if it is
+// earlier, zero expires means the token doesn't expire on its own
+func (c *tokenCache) add(token string, p *Principal, expires time.Time) {
+	if c.size <= 0 || c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &tokenEntry{token, p, time.Now().Add(c.ttl)}
+	if !expires.IsZero() && expires.Before(entry.expires) {
+		entry.expires = expires
+	}
+	if e, ok := c.entries[token]; ok {
+		e.Value = entry
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[token] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*tokenEntry).token)
+	}
+}
+
+func (c *tokenCache) remove(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[token]; ok {
+		c.order.Remove(e)
+		delete(c.entries, token)
+	}
+}
+
+// removeUID forgets every token of user uid
+func (c *tokenCache) removeUID(uid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for token, e := range c.entries {
+		if e.Value.(*tokenEntry).principal.UID == uid {
+			c.order.Remove(e)
+			delete(c.entries, token)
+		}
+	}
+}
+
+// authenticate resolves token to its owner, it returns nil principal if the
+// token isn't valid
+func (s *Server) authenticate(ctx context.Context, token string) (*Principal, error) {
+	if p, ok := s.tokens.get(token); ok {
+		return p, nil
+	}
+
+	if s.verifier != nil {
+		p, expires, err := s.verifier.verify(token)
+		switch err {
+		case nil:
+			s.tokens.add(token, p, expires)
+			return p, nil
+		case errNotJWT, errUnknownKey:
+		default:
+			logger(ctx).WithError(err).Info("rejected access token")
+			return nil, nil
+		}
+	}
+
+	uid, err := s.getUIDByToken(ctx, token)
+	switch status.Code(err) {
+	case codes.OK:
+	case codes.Unauthenticated, codes.NotFound, codes.PermissionDenied:
+		return nil, nil
+	default:
+		return nil, err
+	}
+
+	if uid == "" {
+		return nil, nil
+	}
+
+	info, err := s.userClient.client.GetUserInfo(ctx, &user.GetUserInfoRequest{Uid: uid})
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Principal{UID: uid, Admin: info.IsAdmin}
+	p.AppID, p.Scopes = tokenGrant(token)
+	s.tokens.add(token, p, time.Time{})
+	return p, nil
+}
+
+// forgetTokensOf evicts cached tokens of the owner of access token, it is
+// called when the owner's tokens are replaced. Failing to resolve the owner
+// only delays eviction until the cache TTL.
+func (s *Server) forgetTokensOf(ctx context.Context, accessToken string) {
+	uid, err := s.getUIDByToken(ctx, accessToken)
+	if err != nil {
+		logger(ctx).WithError(err).Warn("can't resolve owner of new access token, cached tokens expire on their own")
+		return
+	}
+
+	s.tokens.removeUID(uid)
+}
+
+// unauthorized rejects request without valid credentials
+func unauthorized(w http.ResponseWriter, r *http.Request, detail string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+	writeError(w, r, http.StatusUnauthorized, detail)
+}
+
+// requireAuth resolves bearer token of the request and puts the caller into
+// its context, requests without a valid token are rejected
+func (s *Server) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := getAuthorizationToken(r)
+		if token == "" {
+			unauthorized(w, r, "bearer token is required")
+			return
+		}
+
+		p, err := s.authenticate(r.Context(), token)
+		if err != nil {
+			handleRPCError(w, r, err)
+			return
+		}
+
+		if p == nil {
+			unauthorized(w, r, "token is invalid or expired")
+			return
+		}
+
+		next(w, r.WithContext(withPrincipal(r.Context(), p)))
+	}
+}
+
+// optionalAuth puts the caller into context of requests with a valid token,
+// the rest are handled as anonymous
+func (s *Server) optionalAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := getAuthorizationToken(r)
+		if token == "" {
+			next(w, r)
+			return
+		}
+
+		p, err := s.authenticate(r.Context(), token)
+		if err != nil {
+			logger(r.Context()).WithError(err).Warn("can't authenticate request, handling it as anonymous")
+		}
+
+		if p != nil {
+			r = r.WithContext(withPrincipal(r.Context(), p))
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,234 @@
+package api
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerHalfOpen = "half-open"
+	breakerOpen     = "open"
+)
+
+// BreakerConfig controls circuit breakers guarding the backends
+type BreakerConfig struct {
+	// FailureRate is the share of failed calls within Window which opens the
+	// breaker, zero disables breakers
+	FailureRate float64
+	// MinRequests is the number of calls within Window needed before the
+	// failure rate is considered
+	MinRequests int
+	// Window is the period over which calls are counted
+	Window time.Duration
+	// OpenTimeout is how long the breaker stays open before letting probe
+	// calls through
+	OpenTimeout time.Duration
+	// HalfOpenRequests is the number of probe calls which have to succeed
+	// to close the breaker
+	HalfOpenRequests int
+}
+
+// DefaultBreakerConfig returns BreakerConfig with sensible defaults
+func DefaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		FailureRate:      0.5,
+		MinRequests:      20,
+		Window:           time.Second * 10,
+		OpenTimeout:      time.Second * 30,
+		HalfOpenRequests: 3,
+	}
+}
+
+// breakerOpenError is returned instead of calling a backend whose breaker is
+// open
+type breakerOpenError struct {
+	backend    string
+	retryAfter time.Duration
+}
+
+func (e *breakerOpenError) Error() string {
+	return "circuit breaker of " + e.backend + " is open"
+}
+
+func (e *breakerOpenError) GRPCStatus() *status.Status {
+	return status.New(codes.Unavailable, e.Error())
+}
+
+// retryAfterSeconds returns value of Retry-After header
+func (e *breakerOpenError) retryAfterSeconds() string {
+	return strconv.Itoa(int(math.Ceil(e.retryAfter.Seconds())))
+}
+
+// Breaker stops calls to a backend which fails too often, so that requests
+// fail fast instead of waiting for it. After OpenTimeout a few probe calls are
+// let through and the breaker closes if they succeed.
+type Breaker struct {
+	backend string
+	conf    BreakerConfig
+
+	mu          sync.Mutex
+	state       string
+	generation  int
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probes      int
+	successes   int
+	rejected    int
+}
+
+// NewBreaker returns closed breaker for backend
+func NewBreaker(backend string, conf BreakerConfig) *Breaker {
+	return &Breaker{backend: backend, conf: conf, state: breakerClosed, windowStart: time.Now()}
+}
+
+func (b *Breaker) enabled() bool {
+	return b != nil && b.conf.FailureRate > 0
+}
+
+// setState must be called with b.mu held
+func (b *Breaker) setState(state string, now time.Time) {
+	if state != b.state {
+		log.WithFields(log.Fields{"backend": b.backend, "from": b.state, "to": state}).Warn("circuit breaker changed state")
+	}
+
+	b.state = state
+	b.generation++
+	b.windowStart = now
+	b.requests, b.failures = 0, 0
+	b.probes, b.successes = 0, 0
+	if state == breakerOpen {
+		b.openedAt = now
+	}
+}
+
+// advance moves open breaker to half-open once OpenTimeout has passed, it
+// must be called with b.mu held
+func (b *Breaker) advance(now time.Time) {
+	if b.state == breakerOpen && now.Sub(b.openedAt) >= b.conf.OpenTimeout {
+		b.setState(breakerHalfOpen, now)
+	}
+}
+
+// allow reports whether a call may be made, it returns generation to be
+// passed to done
+func (b *Breaker) allow() (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.advance(now)
+	switch b.state {
+	case breakerOpen:
+		b.rejected++
+		return 0, &breakerOpenError{b.backend, b.openedAt.Add(b.conf.OpenTimeout).Sub(now)}
+	case breakerHalfOpen:
+		if b.probes >= b.conf.HalfOpenRequests {
+			b.rejected++
+			return 0, &breakerOpenError{b.backend, time.Second}
+		}
+		b.probes++
+	default:
+		if now.Sub(b.windowStart) >= b.conf.Window {
+			b.windowStart = now
+			b.requests, b.failures = 0, 0
+		}
+	}
+
+	return b.generation, nil
+}
+
+// done records result of a call allowed in generation
+func (b *Breaker) done(generation int, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+
+	now := time.Now()
+	switch b.state {
+	case breakerClosed:
+		b.requests++
+		if failed {
+			b.failures++
+		}
+
+		if b.requests >= b.conf.MinRequests && float64(b.failures) >= b.conf.FailureRate*float64(b.requests) {
+			b.setState(breakerOpen, now)
+		}
+	case breakerHalfOpen:
+		if failed {
+			b.setState(breakerOpen, now)
+			return
+		}
+
+		b.successes++
+		if b.successes >= b.conf.HalfOpenRequests {
+			b.setState(breakerClosed, now)
+		}
+	}
+}
+
+// State returns current state of the breaker: closed, half-open or open
+func (b *Breaker) State() string {
+	if !b.enabled() {
+		return breakerClosed
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.advance(time.Now())
+	return b.state
+}
+
+// rejectedCalls returns the number of calls which failed fast
+func (b *Breaker) rejectedCalls() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.rejected
+}
+
+// isBackendFailure reports whether err says the backend is unhealthy rather
+// than the request is wrong
+func isBackendFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown, codes.ResourceExhausted:
+		return true
+	}
+
+	return false
+}
+
+// Interceptor guards calls of a connection with the breaker
+func (b *Breaker) Interceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if !b.enabled() {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		generation, err := b.allow()
+		if err != nil {
+			return err
+		}
+
+		err = invoker(ctx, method, req, reply, cc, opts...)
+		// calls abandoned by the client say nothing about the backend
+		failed := isBackendFailure(err) && ctx.Err() != context.Canceled
+		b.done(generation, failed)
+		return err
+	}
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
@@ -32,7 +33,7 @@ func (s *Server) getCategories() http.HandlerFunc {
 		if page != "" {
 			n, err := strconv.Atoi(page)
 			if err != nil {
-				http.Error(w, "can't parse query parameter `page`", http.StatusBadRequest)
+				writeError(w, r, http.StatusBadRequest, "can't parse query parameter `page`")
 				return
 			}
 			pageNum = int32(n)
@@ -41,7 +42,7 @@ func (s *Server) getCategories() http.HandlerFunc {
 		if size != "" {
 			n, err := strconv.Atoi(size)
 			if err != nil {
-				http.Error(w, "can't parse query parameter `size`", http.StatusBadRequest)
+				writeError(w, r, http.StatusBadRequest, "can't parse query parameter `size`")
 				return
 			}
 			sizeNum = int32(n)
@@ -52,7 +53,7 @@ func (s *Server) getCategories() http.HandlerFunc {
 			&category.ListCategoriesRequest{PageSize: sizeNum, PageNumber: pageNum},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -67,7 +68,7 @@ func (s *Server) getCategories() http.HandlerFunc {
 		resp := response{categories, sizeNum, pageNum}
 		json, err := json.Marshal(resp)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -93,14 +94,14 @@ func (s *Server) getCategoryInfo() http.HandlerFunc {
 			&category.GetCategoryInfoRequest{Uid: uid},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		resp := response{uid, c.UserUid, c.Name, c.Description}
 		json, err := json.Marshal(resp)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -108,6 +109,7 @@ func (s *Server) getCategoryInfo() http.HandlerFunc {
 		w.Write(json)
 	}
 }
+
 func (s *Server) createCategory() http.HandlerFunc {
 	type request struct {
 		Name        string `json:"name"`
@@ -122,33 +124,18 @@ func (s *Server) createCategory() http.HandlerFunc {
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		userToken := getAuthorizationToken(r)
-		if userToken == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
-		userUID, err := s.getUIDByToken(userToken)
-		if err != nil {
-			handleRPCError(w, err)
-			return
-		}
-
-		if userUID == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
+		userUID := principalFrom(r.Context()).UID
 
 		var req request
 		b, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		err = json.Unmarshal(b, &req)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			writeError(w, r, http.StatusUnprocessableEntity, err.Error())
 			return
 		}
 
@@ -157,14 +144,14 @@ func (s *Server) createCategory() http.HandlerFunc {
 			&category.CreateCategoryRequest{Name: req.Name, Description: req.Description, UserUid: userUID},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		response := response{c.Uid, c.UserUid, c.Name, c.Description}
 		json, err := json.Marshal(response)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -195,7 +182,7 @@ func (s *Server) getReports() http.HandlerFunc {
 		if page != "" {
 			n, err := strconv.Atoi(page)
 			if err != nil {
-				http.Error(w, "can't parse query parameter `page`", http.StatusBadRequest)
+				writeError(w, r, http.StatusBadRequest, "can't parse query parameter `page`")
 				return
 			}
 			pageNum = int32(n)
@@ -204,51 +191,21 @@ func (s *Server) getReports() http.HandlerFunc {
 		if size != "" {
 			n, err := strconv.Atoi(size)
 			if err != nil {
-				http.Error(w, "can't parse query parameter `size`", http.StatusBadRequest)
+				writeError(w, r, http.StatusBadRequest, "can't parse query parameter `size`")
 				return
 			}
 			sizeNum = int32(n)
 		}
 
-		userToken := getAuthorizationToken(r)
-		if userToken == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
-		userUID, err := s.getUIDByToken(userToken)
-		if err != nil {
-			handleRPCError(w, err)
-			return
-		}
-
-		if userUID == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
 		vars := mux.Vars(r)
 		categoryUID := vars["uid"]
 
 		ctx := r.Context()
-		categoryInfo, err := s.categoryClient.client.GetCategoryInfo(ctx,
-			&category.GetCategoryInfoRequest{Uid: categoryUID},
-		)
-		if err != nil {
-			handleRPCError(w, err)
-			return
-		}
-
-		if userUID != categoryInfo.UserUid {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-
 		reportsResponse, err := s.categoryClient.client.ListReports(ctx,
 			&category.ListReportsRequest{CategoryUid: categoryUID, PageSize: sizeNum, PageNumber: pageNum},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -261,7 +218,7 @@ func (s *Server) getReports() http.HandlerFunc {
 			reports[i].Reason = singleReport.Reason
 			reports[i].CreatedAt, err = ptypes.Timestamp(singleReport.CreatedAt)
 			if err != nil {
-				handleRPCError(w, err)
+				handleRPCError(w, r, err)
 				return
 			}
 		}
@@ -269,7 +226,7 @@ func (s *Server) getReports() http.HandlerFunc {
 		resp := response{reports, sizeNum, pageNum}
 		json, err := json.Marshal(resp)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -280,49 +237,60 @@ func (s *Server) getReports() http.HandlerFunc {
 
 func (s *Server) deleteReport() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userToken := getAuthorizationToken(r)
-		if userToken == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
+		vars := mux.Vars(r)
+		uid := vars["uid"]
 
-		userUID, err := s.getUIDByToken(userToken)
+		ctx := r.Context()
+		_, err := s.categoryClient.client.DeleteReport(ctx,
+			&category.DeleteReportRequest{Uid: uid},
+		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
-		if userUID == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) deleteCategory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUID := principalFrom(r.Context()).UID
 
 		vars := mux.Vars(r)
 		uid := vars["uid"]
-		categoryUID := vars["categoryuid"]
 
-		ctx := r.Context()
-		categoryInfo, err := s.categoryClient.client.GetCategoryInfo(ctx,
-			&category.GetCategoryInfoRequest{Uid: categoryUID},
-		)
+		c := newCascade(cascadeDeleteCategory, uid, userUID)
+		// The category goes last, so that its posts and reports can still be
+		// listed and no new post lands in a category which is already gone
+		err := s.startCascade(r.Context(), c, []workerRequest{
+			newWorkerRequest(deleteCategoryPostsQueue, uid),
+			newWorkerRequest(deleteCategoryReportsQueue, uid),
+		}, newWorkerRequest(deleteCategoryQueue, uid))
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
+		s.lookups.remove("category/" + uid)
 
-		if userUID != categoryInfo.UserUid {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+		acceptCascade(w, r, c)
+	}
+}
 
-		_, err = s.categoryClient.client.DeleteReport(ctx,
-			&category.DeleteReportRequest{Uid: uid},
+// listReportUIDs returns UIDs of all reports of category categoryUID
+func listReportUIDs(ctx context.Context, catc category.CategoryClient, categoryUID string) ([]string, error) {
+	return listPages(func(page int32) ([]string, error) {
+		reportsResponse, err := catc.ListReports(ctx,
+			&category.ListReportsRequest{CategoryUid: categoryUID, PageSize: cascadePageSize, PageNumber: page},
 		)
 		if err != nil {
-			handleRPCError(w, err)
-			return
+			return nil, err
 		}
 
-		w.WriteHeader(http.StatusNoContent)
-	}
+		uids := make([]string, len(reportsResponse.Reports))
+		for i, report := range reportsResponse.Reports {
+			uids[i] = report.Uid
+		}
+		return uids, nil
+	})
 }
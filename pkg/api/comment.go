@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
@@ -10,11 +11,16 @@ import (
 	category "github.com/andreymgn/RSOI-category/pkg/category/proto"
 	comment "github.com/andreymgn/RSOI-comment/pkg/comment/proto"
 	post "github.com/andreymgn/RSOI-post/pkg/post/proto"
-	user "github.com/andreymgn/RSOI-user/pkg/user/proto"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/gorilla/mux"
 )
 
+const (
+	// cascadePageSize is the page size requested when listing everything a
+	// resource owns, e.g. all comments of a post
+	cascadePageSize = 100
+)
+
 func (s *Server) getPostComments() http.HandlerFunc {
 	type c struct {
 		UID        string
@@ -38,7 +44,7 @@ func (s *Server) getPostComments() http.HandlerFunc {
 		if page != "" {
 			n, err := strconv.Atoi(page)
 			if err != nil {
-				http.Error(w, "can't parse query parameter `page`", http.StatusBadRequest)
+				writeError(w, r, http.StatusBadRequest, "can't parse query parameter `page`")
 				return
 			}
 			pageNum = int32(n)
@@ -47,7 +53,7 @@ func (s *Server) getPostComments() http.HandlerFunc {
 		if size != "" {
 			n, err := strconv.Atoi(size)
 			if err != nil {
-				http.Error(w, "can't parse query parameter `size`", http.StatusBadRequest)
+				writeError(w, r, http.StatusBadRequest, "can't parse query parameter `size`")
 				return
 			}
 			sizeNum = int32(n)
@@ -62,12 +68,12 @@ func (s *Server) getPostComments() http.HandlerFunc {
 			&post.CheckPostExistsRequest{Uid: postUID},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		if !checkExistsResponse.Exists {
-			w.WriteHeader(http.StatusNotFound)
+			writeError(w, r, http.StatusNotFound, "")
 			return
 		}
 
@@ -75,7 +81,7 @@ func (s *Server) getPostComments() http.HandlerFunc {
 			&comment.ListCommentsRequest{PostUid: postUID, CommentUid: uid, PageSize: sizeNum, PageNumber: pageNum},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -87,13 +93,13 @@ func (s *Server) getPostComments() http.HandlerFunc {
 			comments[i].ParentUID = singleComment.ParentUid
 			comments[i].CreatedAt, err = ptypes.Timestamp(singleComment.CreatedAt)
 			if err != nil {
-				handleRPCError(w, err)
+				handleRPCError(w, r, err)
 				return
 			}
 
 			comments[i].ModifiedAt, err = ptypes.Timestamp(singleComment.ModifiedAt)
 			if err != nil {
-				handleRPCError(w, err)
+				handleRPCError(w, r, err)
 				return
 			}
 
@@ -108,7 +114,7 @@ func (s *Server) getPostComments() http.HandlerFunc {
 
 		json, err := json.Marshal(resp)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -138,12 +144,12 @@ func (s *Server) getSingleComment() http.HandlerFunc {
 			&post.CheckPostExistsRequest{Uid: postUID},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		if !checkExistsResponse.Exists {
-			w.WriteHeader(http.StatusNotFound)
+			writeError(w, r, http.StatusNotFound, "")
 			return
 		}
 
@@ -151,7 +157,7 @@ func (s *Server) getSingleComment() http.HandlerFunc {
 			&comment.GetCommentRequest{Uid: uid},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -162,13 +168,13 @@ func (s *Server) getSingleComment() http.HandlerFunc {
 		res.ParentUID = singleComment.ParentUid
 		res.CreatedAt, err = ptypes.Timestamp(singleComment.CreatedAt)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		res.ModifiedAt, err = ptypes.Timestamp(singleComment.ModifiedAt)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -180,7 +186,7 @@ func (s *Server) getSingleComment() http.HandlerFunc {
 
 		json, err := json.Marshal(res)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -206,33 +212,18 @@ func (s *Server) createComment() http.HandlerFunc {
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		userToken := getAuthorizationToken(r)
-		if userToken == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
-		userUID, err := s.getUIDByToken(userToken)
-		if err != nil {
-			handleRPCError(w, err)
-			return
-		}
-
-		if userUID == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
+		userUID := principalFrom(r.Context()).UID
 
 		var req request
 		b, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		err = json.Unmarshal(b, &req)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			writeError(w, r, http.StatusUnprocessableEntity, err.Error())
 			return
 		}
 
@@ -244,12 +235,12 @@ func (s *Server) createComment() http.HandlerFunc {
 			&post.CheckPostExistsRequest{Uid: postUID},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		if !checkExistsResponse.Exists {
-			w.WriteHeader(http.StatusNotFound)
+			writeError(w, r, http.StatusNotFound, "")
 			return
 		}
 
@@ -257,26 +248,26 @@ func (s *Server) createComment() http.HandlerFunc {
 			&comment.CreateCommentRequest{PostUid: postUID, Body: req.Body, ParentUid: req.ParentUID, UserUid: userUID},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		createdAt, err := ptypes.Timestamp(c.CreatedAt)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		modifiedAt, err := ptypes.Timestamp(c.ModifiedAt)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		response := response{c.Uid, c.UserUid, c.PostUid, c.Body, c.ParentUid, createdAt, modifiedAt}
 		json, err := json.Marshal(response)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -291,33 +282,16 @@ func (s *Server) updateComment() http.HandlerFunc {
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		userToken := getAuthorizationToken(r)
-		if userToken == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
-		userUID, err := s.getUIDByToken(userToken)
-		if err != nil {
-			handleRPCError(w, err)
-			return
-		}
-
-		if userUID == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
 		var req request
 		b, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		err = json.Unmarshal(b, &req)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			writeError(w, r, http.StatusUnprocessableEntity, err.Error())
 			return
 		}
 
@@ -330,25 +304,12 @@ func (s *Server) updateComment() http.HandlerFunc {
 			&post.CheckPostExistsRequest{Uid: postUID},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		if !checkExistsResponse.Exists {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-
-		owner, err := s.commentClient.client.GetOwner(ctx,
-			&comment.GetOwnerRequest{Uid: uid},
-		)
-		if err != nil {
-			handleRPCError(w, err)
-			return
-		}
-
-		if userUID != owner.OwnerUid {
-			w.WriteHeader(http.StatusUnauthorized)
+			writeError(w, r, http.StatusNotFound, "")
 			return
 		}
 
@@ -356,7 +317,7 @@ func (s *Server) updateComment() http.HandlerFunc {
 			&comment.UpdateCommentRequest{Uid: uid, Body: req.Body},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -366,82 +327,29 @@ func (s *Server) updateComment() http.HandlerFunc {
 
 func (s *Server) deleteComment() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userToken := getAuthorizationToken(r)
-		if userToken == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
-		userUID, err := s.getUIDByToken(userToken)
-		if err != nil {
-			handleRPCError(w, err)
-			return
-		}
-
-		if userUID == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
 		vars := mux.Vars(r)
 		uid := vars["uid"]
 		postUID := vars["postuid"]
-		categoryUID := vars["categoryuid"]
 
 		ctx := r.Context()
 		checkExistsResponse, err := s.postClient.client.CheckPostExists(ctx,
 			&post.CheckPostExistsRequest{Uid: postUID},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		if !checkExistsResponse.Exists {
-			w.WriteHeader(http.StatusNotFound)
+			writeError(w, r, http.StatusNotFound, "")
 			return
 		}
 
-		owner, err := s.commentClient.client.GetOwner(ctx,
-			&comment.GetOwnerRequest{Uid: uid},
-		)
-		if err != nil {
-			handleRPCError(w, err)
-			return
-		}
-
-		if userUID != owner.OwnerUid {
-			// Check if current user is global admin
-			userInfo, err := s.userClient.client.GetUserInfo(ctx,
-				&user.GetUserInfoRequest{Uid: userUID},
-			)
-			if err != nil {
-				handleRPCError(w, err)
-				return
-			}
-
-			if !userInfo.IsAdmin {
-				// Check if current user is category admin
-				categoryInfo, err := s.categoryClient.client.GetCategoryInfo(ctx,
-					&category.GetCategoryInfoRequest{Uid: categoryUID},
-				)
-				if err != nil {
-					handleRPCError(w, err)
-					return
-				}
-
-				if userUID != categoryInfo.UserUid {
-					w.WriteHeader(http.StatusUnauthorized)
-					return
-				}
-			}
-		}
-
 		_, err = s.commentClient.client.RemoveContent(ctx,
 			&comment.RemoveContentRequest{Uid: uid},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -464,33 +372,16 @@ func (s *Server) reportComment() http.HandlerFunc {
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		userToken := getAuthorizationToken(r)
-		if userToken == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
-		userUID, err := s.getUIDByToken(userToken)
-		if err != nil {
-			handleRPCError(w, err)
-			return
-		}
-
-		if userUID == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
 		var req request
 		b, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		err = json.Unmarshal(b, &req)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			writeError(w, r, http.StatusUnprocessableEntity, err.Error())
 			return
 		}
 
@@ -504,20 +395,20 @@ func (s *Server) reportComment() http.HandlerFunc {
 			&category.CreateReportRequest{CategoryUid: categoryUID, PostUid: postUID, CommentUid: commentUID, Reason: req.Reason},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		createdAt, err := ptypes.Timestamp(report.CreatedAt)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		response := response{report.Uid, report.CategoryUid, report.PostUid, report.CommentUid, report.Reason, createdAt}
 		json, err := json.Marshal(response)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -525,3 +416,88 @@ func (s *Server) reportComment() http.HandlerFunc {
 		w.Write(json)
 	}
 }
+
+// listPages calls list for consecutive pages and returns UIDs found on all of
+// them. A short page doesn't mean the last one, backends may cap the page size
+// below the requested one, so listing stops at a page with nothing new.
+func listPages(list func(page int32) ([]string, error)) ([]string, error) {
+	var uids []string
+	seen := make(map[string]bool)
+	for page := int32(0); ; page++ {
+		pageUIDs, err := list(page)
+		if err != nil {
+			return nil, err
+		}
+
+		found := false
+		for _, uid := range pageUIDs {
+			if !seen[uid] {
+				seen[uid] = true
+				found = true
+				uids = append(uids, uid)
+			}
+		}
+
+		if !found {
+			return uids, nil
+		}
+	}
+}
+
+// listCommentUIDs returns UIDs of all comments of post postUID including
+// nested replies. Every page of every level of the comment tree is visited.
+func listCommentUIDs(ctx context.Context, cc comment.CommentClient, postUID string) ([]string, error) {
+	var uids []string
+	seen := make(map[string]bool)
+	parents := []string{""}
+	for len(parents) > 0 {
+		parent := parents[0]
+		parents = parents[1:]
+
+		children, err := listPages(func(page int32) ([]string, error) {
+			commentsResponse, err := cc.ListComments(ctx,
+				&comment.ListCommentsRequest{PostUid: postUID, CommentUid: parent, PageSize: cascadePageSize, PageNumber: page},
+			)
+			if err != nil {
+				return nil, err
+			}
+
+			uids := make([]string, len(commentsResponse.Comments))
+			for i, c := range commentsResponse.Comments {
+				uids[i] = c.Uid
+			}
+			return uids, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, uid := range children {
+			if !seen[uid] {
+				seen[uid] = true
+				uids = append(uids, uid)
+				parents = append(parents, uid)
+			}
+		}
+	}
+
+	return uids, nil
+}
+
+// listUserCommentUIDs returns UIDs of all comments of user userUID
+func listUserCommentUIDs(ctx context.Context, cc comment.CommentClient, userUID string) ([]string, error) {
+	return listPages(func(page int32) ([]string, error) {
+		commentsResponse, err := cc.ListCommentsByUser(ctx,
+			&comment.ListCommentsByUserRequest{UserUid: userUID, PageSize: cascadePageSize, PageNumber: page},
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		uids := make([]string, len(commentsResponse.Comments))
+		for i, c := range commentsResponse.Comments {
+			uids[i] = c.Uid
+		}
+		return uids, nil
+	})
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+
+	comment "github.com/andreymgn/RSOI-comment/pkg/comment/proto"
+	"google.golang.org/grpc"
+)
+
+// fakeCommentClient serves a comment tree page by page
+type fakeCommentClient struct {
+	comment.CommentClient
+	// children maps parent UID to UIDs of its replies, "" is the post itself
+	children map[string][]string
+	// maxPageSize caps the requested page size like some backends do
+	maxPageSize int32
+	// ignorePage makes every request return the first page
+	ignorePage bool
+	// failOn makes listing replies of this parent fail
+	failOn string
+}
+
+func (c *fakeCommentClient) ListComments(ctx context.Context, in *comment.ListCommentsRequest, opts ...grpc.CallOption) (*comment.ListCommentsResponse, error) {
+	if c.failOn != "" && in.CommentUid == c.failOn {
+		return nil, errors.New("comment service is down")
+	}
+
+	size := in.PageSize
+	if c.maxPageSize > 0 && size > c.maxPageSize {
+		size = c.maxPageSize
+	}
+
+	page := in.PageNumber
+	if c.ignorePage {
+		page = 0
+	}
+
+	all := c.children[in.CommentUid]
+	start, end := int(page*size), int((page+1)*size)
+	if start > len(all) {
+		start = len(all)
+	}
+	if end > len(all) {
+		end = len(all)
+	}
+
+	resp := &comment.ListCommentsResponse{PageSize: size, PageNumber: page}
+	for _, uid := range all[start:end] {
+		resp.Comments = append(resp.Comments, &comment.SingleComment{Uid: uid, PostUid: "post", ParentUid: in.CommentUid})
+	}
+
+	return resp, nil
+}
+
+// commentUIDs returns n UIDs starting with prefix
+func commentUIDs(prefix string, n int) []string {
+	uids := make([]string, n)
+	for i := range uids {
+		uids[i] = fmt.Sprintf("%s%d", prefix, i)
+	}
+
+	return uids
+}
+
+func TestListCommentUIDs(t *testing.T) {
+	nested := map[string][]string{
+		"":   commentUIDs("c", 150),
+		"c0": commentUIDs("c0-r", 120),
+		"c7": {"c7-r0"},
+	}
+	nested["c0-r119"] = []string{"deep"}
+
+	tests := []struct {
+		name   string
+		client *fakeCommentClient
+		want   int
+		err    bool
+	}{
+		{"no comments", &fakeCommentClient{}, 0, false},
+		{"single page", &fakeCommentClient{children: map[string][]string{"": commentUIDs("c", 3)}}, 3, false},
+		{"exactly one full page", &fakeCommentClient{children: map[string][]string{"": commentUIDs("c", cascadePageSize)}}, cascadePageSize, false},
+		{"many pages", &fakeCommentClient{children: map[string][]string{"": commentUIDs("c", 250)}}, 250, false},
+		{"page size capped by backend", &fakeCommentClient{children: map[string][]string{"": commentUIDs("c", 30)}, maxPageSize: 7}, 30, false},
+		{"nested replies on many pages", &fakeCommentClient{children: nested}, 150 + 120 + 1 + 1, false},
+		{"nested replies with capped page size", &fakeCommentClient{children: nested, maxPageSize: 10}, 150 + 120 + 1 + 1, false},
+		{"page number ignored by backend", &fakeCommentClient{children: map[string][]string{"": commentUIDs("c", 30)}, maxPageSize: 10, ignorePage: true}, 10, false},
+		{"error listing replies", &fakeCommentClient{children: nested, failOn: "c7"}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uids, err := listCommentUIDs(context.Background(), tt.client, "post")
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(uids) != tt.want {
+				t.Fatalf("got %d comments, want %d", len(uids), tt.want)
+			}
+
+			seen := make(map[string]bool)
+			for _, uid := range uids {
+				if seen[uid] {
+					t.Fatalf("comment %s listed twice", uid)
+				}
+				seen[uid] = true
+			}
+		})
+	}
+}
+
+func TestDeletePostCommentsJob(t *testing.T) {
+	path, cleanup := tempOutbox(t)
+	defer cleanup()
+
+	o, err := openOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.close()
+
+	tree := map[string][]string{
+		"":    commentUIDs("c", 12),
+		"c3":  commentUIDs("c3-r", 9),
+		"c11": {"c11-r0"},
+	}
+	s := &Server{
+		commentClient: &CommentClient{&fakeCommentClient{children: tree, maxPageSize: 5}},
+		outbox:        o,
+		queues:        map[string]*jobQueue{deleteCommentQueue: newJobQueue()},
+	}
+
+	req := newWorkerRequest(deletePostCommentsQueue, "post")
+	req.cascadeID = "cascade"
+	if err := s.deletePostCommentsJob(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, job := range o.pending() {
+		if job.queue != deleteCommentQueue || job.cascadeID != "cascade" {
+			t.Fatalf("unexpected job %+v", job)
+		}
+		got = append(got, job.uid)
+	}
+
+	want := append(append(commentUIDs("c", 12), commentUIDs("c3-r", 9)...), "c11-r0")
+	sort.Strings(got)
+	sort.Strings(want)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("deletion enqueued for %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/cors"
+)
+
+// CORSConfig controls cross-origin requests
+type CORSConfig struct {
+	// AllowedOrigins may contain "*" allowing any origin or a single
+	// wildcard, e.g. "https://*.example.com". No origin is allowed when it
+	// is empty.
+	AllowedOrigins []string
+	AllowedMethods []string
+	AllowedHeaders []string
+	// ExposedHeaders are response headers readable by scripts
+	ExposedHeaders []string
+	// AllowCredentials lets browsers send cookies, it can't be combined
+	// with "*" origin
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache preflight responses
+	MaxAge time.Duration
+}
+
+// DefaultCORSConfig returns policy which lets scripts call the API with a
+// bearer token once their origins are allowed
+func DefaultCORSConfig() CORSConfig {
+	return CORSConfig{
+		AllowedMethods: []string{"GET", "POST", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders: []string{"Origin", "X-Requested-With", "Content-Type", "Accept", "Authorization", requestIDHeader},
+		ExposedHeaders: []string{
+			"Location", "Retry-After", requestIDHeader,
+			"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset",
+		},
+		MaxAge: time.Minute * 10,
+	}
+}
+
+func newCORS(c CORSConfig) *cors.Cors {
+	opts := cors.Options{
+		AllowedOrigins:   c.AllowedOrigins,
+		AllowedMethods:   c.AllowedMethods,
+		AllowedHeaders:   c.AllowedHeaders,
+		ExposedHeaders:   c.ExposedHeaders,
+		AllowCredentials: c.AllowCredentials,
+		MaxAge:           int(c.MaxAge / time.Second),
+	}
+	// rs/cors allows every origin when none are listed
+	if len(c.AllowedOrigins) == 0 {
+		opts.AllowOriginFunc = func(string) bool { return false }
+	}
+
+	return cors.New(opts)
+}
+
+// cors applies CORS policy of the longest matching override or the default
+// one. It runs before routing because preflight requests match no route.
+func (s *Server) cors(next http.Handler) http.Handler {
+	type override struct {
+		prefix  string
+		handler http.Handler
+	}
+
+	overrides := make([]override, 0, len(s.httpConfig.CORSOverrides))
+	for prefix, c := range s.httpConfig.CORSOverrides {
+		overrides = append(overrides, override{prefix, newCORS(c).Handler(next)})
+	}
+	sort.Slice(overrides, func(i, j int) bool { return len(overrides[i].prefix) > len(overrides[j].prefix) })
+
+	def := newCORS(s.httpConfig.CORS).Handler(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, o := range overrides {
+			if strings.HasPrefix(r.URL.Path, o.prefix) {
+				o.handler.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		def.ServeHTTP(w, r)
+	})
+}
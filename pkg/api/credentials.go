@@ -0,0 +1,132 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// BackendTLSConfig controls TLS connection to a backend
+type BackendTLSConfig struct {
+	// CAFile is the PEM bundle used to verify the backend's certificate
+	CAFile string
+	// CertFile and KeyFile hold the client certificate presented to the
+	// backend, mutual TLS is disabled when they are empty
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name the backend's certificate is checked
+	// against
+	ServerName string
+}
+
+// backendTLS is TLS configuration shared by clones of BackendCredentials
+type backendTLS struct {
+	*fileReloader
+
+	mu     sync.RWMutex
+	config *tls.Config
+}
+
+// BackendCredentials are gRPC transport credentials which verify the backend
+// with a CA bundle and present a client certificate to it. Files are re-read
+// by Watch when they change, new connections use the new files and
+// established ones are not interrupted.
+type BackendCredentials struct {
+	tls        *backendTLS
+	serverName string
+}
+
+// NewBackendCredentials loads files of c
+func NewBackendCredentials(c BackendTLSConfig) (*BackendCredentials, error) {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, errors.New("client certificate and key must be set together")
+	}
+
+	paths := []string{c.CAFile}
+	if c.CertFile != "" {
+		paths = append(paths, c.CertFile, c.KeyFile)
+	}
+
+	t := &backendTLS{}
+	t.fileReloader = &fileReloader{name: "TLS files", paths: paths, load: func() error {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return err
+		}
+
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+
+		config := &tls.Config{RootCAs: roots}
+		if c.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+			if err != nil {
+				return err
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+
+		t.mu.Lock()
+		t.config = config
+		t.mu.Unlock()
+		return nil
+	}}
+
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+
+	return &BackendCredentials{t, c.ServerName}, nil
+}
+
+// Watch reloads files when they change or the process receives SIGHUP until
+// ctx is done
+func (c *BackendCredentials) Watch(ctx context.Context) {
+	c.tls.watch(ctx)
+}
+
+// current returns credentials built from the latest files
+func (c *BackendCredentials) current() credentials.TransportCredentials {
+	c.tls.mu.RLock()
+	config := c.tls.config.Clone()
+	c.tls.mu.RUnlock()
+
+	config.ServerName = c.serverName
+	return credentials.NewTLS(config)
+}
+
+// ClientHandshake implements credentials.TransportCredentials
+func (c *BackendCredentials) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return c.current().ClientHandshake(ctx, authority, conn)
+}
+
+// ServerHandshake implements credentials.TransportCredentials
+func (c *BackendCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.New("backend credentials can't be used by a server")
+}
+
+// Info implements credentials.TransportCredentials
+func (c *BackendCredentials) Info() credentials.ProtocolInfo {
+	return c.current().Info()
+}
+
+// Clone implements credentials.TransportCredentials, the clone shares files
+// with c
+func (c *BackendCredentials) Clone() credentials.TransportCredentials {
+	return &BackendCredentials{c.tls, c.serverName}
+}
+
+// OverrideServerName implements credentials.TransportCredentials
+func (c *BackendCredentials) OverrideServerName(name string) error {
+	c.serverName = name
+	return nil
+}
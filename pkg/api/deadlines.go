@@ -0,0 +1,141 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RPCConfig controls deadlines and retries of backend calls. Methods are named
+// either in full, e.g. /post.Post/GetPost, or by the name alone, e.g. GetPost.
+type RPCConfig struct {
+	// Timeout is the deadline of a single attempt of a call, zero disables it
+	Timeout time.Duration
+	// Timeouts overrides Timeout for individual methods
+	Timeouts map[string]time.Duration
+	// RetryAttempts is the maximum number of attempts of an idempotent call,
+	// 1 disables retries
+	RetryAttempts int
+	// RetryBaseBackoff is the delay before the first retry, it doubles with
+	// every subsequent attempt
+	RetryBaseBackoff time.Duration
+	// RetryMaxBackoff caps the delay between attempts
+	RetryMaxBackoff time.Duration
+	// RetryMethods lists idempotent methods which are retried when the
+	// backend is unavailable or too slow
+	RetryMethods []string
+}
+
+// DefaultRPCConfig returns RPCConfig which retries reads of every backend
+func DefaultRPCConfig() RPCConfig {
+	return RPCConfig{
+		Timeout:          time.Second * 5,
+		RetryAttempts:    3,
+		RetryBaseBackoff: time.Millisecond * 50,
+		RetryMaxBackoff:  time.Second,
+		RetryMethods: []string{
+			"ListPosts", "ListPostsByCategory", "ListPostsByUser", "GetPost", "GetPostOwner", "CheckPostExists",
+			"ListComments", "ListCommentsByUser", "GetComment", "GetOwner",
+			"ListCategories", "GetCategoryInfo", "ListReports",
+			"GetPostStats",
+			"GetUserInfo", "GetUserByAccessToken", "GetAppInfo", "ListAppsByOwner",
+		},
+	}
+}
+
+// methodKeys returns names under which fullMethod may be configured
+func methodKeys(fullMethod string) []string {
+	return []string{fullMethod, fullMethod[strings.LastIndex(fullMethod, "/")+1:]}
+}
+
+// DeadlineInterceptor limits duration of every call, the deadline of the
+// request the call is made for still applies if it is shorter
+func DeadlineInterceptor(c RPCConfig) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		timeout := c.Timeout
+		for _, key := range methodKeys(method) {
+			if t, ok := c.Timeouts[key]; ok {
+				timeout = t
+				break
+			}
+		}
+
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// RetryInterceptor retries idempotent calls which failed with Unavailable or
+// DeadlineExceeded while the request they are made for has time left. Calls
+// rejected by an open circuit breaker are not retried.
+func RetryInterceptor(c RPCConfig) grpc.UnaryClientInterceptor {
+	idempotent := make(map[string]bool, len(c.RetryMethods))
+	for _, m := range c.RetryMethods {
+		idempotent[m] = true
+	}
+
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		keys := methodKeys(method)
+		if c.RetryAttempts <= 1 || !(idempotent[keys[0]] || idempotent[keys[1]]) {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		for attempt := 1; ; attempt++ {
+			err := invoker(ctx, method, req, reply, cc, opts...)
+			if _, open := err.(*breakerOpenError); open || attempt >= c.RetryAttempts || ctx.Err() != nil {
+				return err
+			}
+
+			switch status.Code(err) {
+			case codes.Unavailable, codes.DeadlineExceeded:
+			default:
+				return err
+			}
+
+			t := time.NewTimer(jitteredBackoff(c.RetryBaseBackoff, c.RetryMaxBackoff, attempt))
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return err
+			case <-t.C:
+			}
+		}
+	}
+}
+
+// routeTimeout applies deadline configured for the matched route to the
+// request context, so that backend calls made for the request give up in time
+func (s *Server) routeTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := s.httpConfig.RouteTimeout
+		if route := mux.CurrentRoute(r); route != nil {
+			if tpl, err := route.GetPathTemplate(); err == nil {
+				if t, ok := s.httpConfig.RouteTimeouts[r.Method+" "+tpl]; ok {
+					timeout = t
+				} else if t, ok := s.httpConfig.RouteTimeouts[tpl]; ok {
+					timeout = t
+				}
+			}
+		}
+
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,190 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// problemContentType is the media type of error responses, see RFC 7807
+const problemContentType = "application/problem+json"
+
+// statusClientClosedRequest is returned when the client went away before the
+// response was ready, there is no standard code for it
+const statusClientClosedRequest = 499
+
+// grpcStatuses maps every gRPC error code to HTTP status of the response
+var grpcStatuses = map[codes.Code]int{
+	codes.Canceled:           statusClientClosedRequest,
+	codes.Unknown:            http.StatusInternalServerError,
+	codes.InvalidArgument:    http.StatusUnprocessableEntity,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.Aborted:            http.StatusConflict,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Internal:           http.StatusInternalServerError,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DataLoss:           http.StatusInternalServerError,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+}
+
+// httpCodes gives errors raised by the gateway itself a code from the same
+// vocabulary as backend errors
+var httpCodes = map[int]codes.Code{
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusUnauthorized:        codes.Unauthenticated,
+	http.StatusForbidden:           codes.PermissionDenied,
+	http.StatusNotFound:            codes.NotFound,
+	http.StatusMethodNotAllowed:    codes.Unimplemented,
+	http.StatusNotAcceptable:       codes.InvalidArgument,
+	http.StatusConflict:            codes.FailedPrecondition,
+	http.StatusUnprocessableEntity: codes.InvalidArgument,
+	http.StatusTooManyRequests:     codes.ResourceExhausted,
+	http.StatusInternalServerError: codes.Internal,
+	http.StatusNotImplemented:      codes.Unimplemented,
+	http.StatusServiceUnavailable:  codes.Unavailable,
+	http.StatusGatewayTimeout:      codes.DeadlineExceeded,
+}
+
+// HTTPStatus returns HTTP status which represents gRPC code c
+func HTTPStatus(c codes.Code) int {
+	if s, ok := grpcStatuses[c]; ok {
+		return s
+	}
+
+	return http.StatusInternalServerError
+}
+
+// codeName converts c to its canonical name, e.g. NotFound becomes NOT_FOUND
+func codeName(c codes.Code) string {
+	if _, ok := grpcStatuses[c]; !ok {
+		c = codes.Unknown
+	}
+
+	var b strings.Builder
+	prev := 'A'
+	for _, r := range c.String() {
+		if unicode.IsUpper(r) && unicode.IsLower(prev) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+		prev = r
+	}
+
+	return b.String()
+}
+
+// fieldViolation says what is wrong with a field of the request
+type fieldViolation struct {
+	Field       string `json:"field"`
+	Description string `json:"description"`
+}
+
+// problem is the body of every error response. Standard members follow RFC
+// 7807, code is one of the canonical gRPC code names.
+type problem struct {
+	Type       string           `json:"type"`
+	Title      string           `json:"title"`
+	Status     int              `json:"status"`
+	Detail     string           `json:"detail,omitempty"`
+	Instance   string           `json:"instance,omitempty"`
+	Code       string           `json:"code"`
+	RequestID  string           `json:"request_id,omitempty"`
+	Violations []fieldViolation `json:"violations,omitempty"`
+}
+
+func newProblem(r *http.Request, status int, code codes.Code, detail string) problem {
+	title := http.StatusText(status)
+	if status == statusClientClosedRequest {
+		title = "Client Closed Request"
+	}
+
+	return problem{
+		Type:      "about:blank",
+		Title:     title,
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		Code:      codeName(code),
+		RequestID: requestIDFrom(r.Context()),
+	}
+}
+
+func writeProblem(w http.ResponseWriter, p problem) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		body = []byte(`{"type":"about:blank","status":500,"code":"INTERNAL"}`)
+		p.Status = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	w.Write(body)
+}
+
+// writeError responds with error raised by the gateway, detail may be empty
+func writeError(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	code, ok := httpCodes[status]
+	if !ok {
+		code = codes.Unknown
+	}
+
+	writeProblem(w, newProblem(r, status, code, detail))
+}
+
+// handleRPCError responds with err returned by a backend or by the gateway
+// while handling the request. Messages of internal errors are logged but not
+// shown to the client. A nil err is a bug of the caller and answered with 500.
+func handleRPCError(w http.ResponseWriter, r *http.Request, err error) {
+	logger(r.Context()).WithError(err).Warn("request failed")
+	if e, ok := err.(*breakerOpenError); ok {
+		w.Header().Set("Retry-After", e.retryAfterSeconds())
+	}
+
+	st := status.Convert(err)
+	switch err {
+	case context.Canceled:
+		st = status.New(codes.Canceled, err.Error())
+	case context.DeadlineExceeded:
+		st = status.New(codes.DeadlineExceeded, err.Error())
+	}
+	if st.Code() == codes.OK {
+		st = status.New(codes.Internal, "")
+	}
+
+	httpStatus := HTTPStatus(st.Code())
+	detail := st.Message()
+	switch st.Code() {
+	case codes.Unknown, codes.Internal, codes.DataLoss:
+		detail = ""
+	}
+
+	p := newProblem(r, httpStatus, st.Code(), detail)
+	for _, d := range st.Details() {
+		switch d := d.(type) {
+		case *errdetails.BadRequest:
+			for _, v := range d.GetFieldViolations() {
+				p.Violations = append(p.Violations, fieldViolation{v.GetField(), v.GetDescription()})
+			}
+		case *errdetails.RetryInfo:
+			if delay := d.GetRetryDelay(); delay != nil && delay.GetSeconds() > 0 {
+				w.Header().Set("Retry-After", strconv.FormatInt(delay.GetSeconds(), 10))
+			}
+		}
+	}
+
+	writeProblem(w, p)
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func decodeProblem(t *testing.T, rec *httptest.ResponseRecorder) problem {
+	if ct := rec.Header().Get("Content-Type"); ct != problemContentType {
+		t.Fatalf("Content-Type is %q, want %q", ct, problemContentType)
+	}
+
+	var p problem
+	if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+		t.Fatalf("body is not a problem document: %v", err)
+	}
+
+	return p
+}
+
+func TestErrorResponses(t *testing.T) {
+	tests := []struct {
+		code   codes.Code
+		status int
+		title  string
+		name   string
+	}{
+		{codes.Canceled, statusClientClosedRequest, "Client Closed Request", "CANCELED"},
+		{codes.Unknown, http.StatusInternalServerError, "Internal Server Error", "UNKNOWN"},
+		{codes.InvalidArgument, http.StatusUnprocessableEntity, "Unprocessable Entity", "INVALID_ARGUMENT"},
+		{codes.DeadlineExceeded, http.StatusGatewayTimeout, "Gateway Timeout", "DEADLINE_EXCEEDED"},
+		{codes.NotFound, http.StatusNotFound, "Not Found", "NOT_FOUND"},
+		{codes.AlreadyExists, http.StatusConflict, "Conflict", "ALREADY_EXISTS"},
+		{codes.PermissionDenied, http.StatusForbidden, "Forbidden", "PERMISSION_DENIED"},
+		{codes.ResourceExhausted, http.StatusTooManyRequests, "Too Many Requests", "RESOURCE_EXHAUSTED"},
+		{codes.FailedPrecondition, http.StatusBadRequest, "Bad Request", "FAILED_PRECONDITION"},
+		{codes.Aborted, http.StatusConflict, "Conflict", "ABORTED"},
+		{codes.OutOfRange, http.StatusBadRequest, "Bad Request", "OUT_OF_RANGE"},
+		{codes.Unimplemented, http.StatusNotImplemented, "Not Implemented", "UNIMPLEMENTED"},
+		{codes.Internal, http.StatusInternalServerError, "Internal Server Error", "INTERNAL"},
+		{codes.Unavailable, http.StatusServiceUnavailable, "Service Unavailable", "UNAVAILABLE"},
+		{codes.DataLoss, http.StatusInternalServerError, "Internal Server Error", "DATA_LOSS"},
+		{codes.Unauthenticated, http.StatusUnauthorized, "Unauthorized", "UNAUTHENTICATED"},
+	}
+
+	if len(tests) != int(codes.Unauthenticated) {
+		t.Fatalf("table covers %d codes, want every code up to Unauthenticated", len(tests))
+	}
+
+	for i, tt := range tests {
+		if tt.code != codes.Code(i+1) {
+			t.Fatalf("row %d is for %s, rows must follow code order", i, tt.code)
+		}
+
+		t.Run(tt.code.String(), func(t *testing.T) {
+			if got := HTTPStatus(tt.code); got != tt.status {
+				t.Fatalf("HTTPStatus is %d, want %d", got, tt.status)
+			}
+
+			rec := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/api/posts/", nil)
+			handleRPCError(rec, r, status.Error(tt.code, "backend says no"))
+			if rec.Code != tt.status {
+				t.Fatalf("handleRPCError responded with %d, want %d", rec.Code, tt.status)
+			}
+
+			p := decodeProblem(t, rec)
+			if p.Type != "about:blank" || p.Title != tt.title || p.Status != tt.status || p.Code != tt.name || p.Instance != "/api/posts/" {
+				t.Fatalf("handleRPCError responded with %+v", p)
+			}
+
+			rec = httptest.NewRecorder()
+			writeError(rec, r, tt.status, "")
+			if rec.Code != tt.status {
+				t.Fatalf("writeError responded with %d, want %d", rec.Code, tt.status)
+			}
+
+			p = decodeProblem(t, rec)
+			if p.Type != "about:blank" || p.Title != tt.title || p.Status != tt.status {
+				t.Fatalf("writeError responded with %+v", p)
+			}
+		})
+	}
+}
+
+func TestErrorResponseWithoutError(t *testing.T) {
+	for _, err := range []error{nil, status.Error(codes.OK, "")} {
+		rec := httptest.NewRecorder()
+		handleRPCError(rec, httptest.NewRequest("GET", "/", nil), err)
+
+		if p := decodeProblem(t, rec); rec.Code != http.StatusInternalServerError || p.Code != "INTERNAL" {
+			t.Fatalf("handleRPCError(%v) responded with %d %+v", err, rec.Code, p)
+		}
+	}
+}
+
+func TestErrorResponsesHideInternalDetails(t *testing.T) {
+	for _, c := range []codes.Code{codes.Unknown, codes.Internal, codes.DataLoss} {
+		rec := httptest.NewRecorder()
+		handleRPCError(rec, httptest.NewRequest("GET", "/", nil), status.Error(c, "db password is hunter2"))
+
+		if p := decodeProblem(t, rec); p.Detail != "" {
+			t.Fatalf("%s response shows detail %q", c, p.Detail)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// BackendOptions controls how readiness of a backend is checked
+type BackendOptions struct {
+	// Optional backends are reported but don't make the gateway unready
+	Optional bool
+	// HealthCheck makes the readiness probe call the standard gRPC health
+	// checking service of the backend
+	HealthCheck bool
+	// Service is the name passed to the health checking service, empty
+	// string asks about the server as a whole
+	Service string
+	// Breaker guards calls to the backend, the backend is reported unhealthy
+	// while it is open
+	Breaker *Breaker
+}
+
+type backend struct {
+	name string
+	conn *grpc.ClientConn
+	opts BackendOptions
+}
+
+// AddBackend registers connection to a backend with the readiness probe. It
+// must be called before Start.
+func (s *Server) AddBackend(name string, conn *grpc.ClientConn, opts BackendOptions) {
+	s.backends = append(s.backends, backend{name, conn, opts})
+}
+
+type backendStatus struct {
+	State    string
+	Breaker  string
+	Healthy  bool
+	Optional bool   `json:",omitempty"`
+	Error    string `json:",omitempty"`
+}
+
+// check reports whether backend b can serve requests
+func (b backend) check(ctx context.Context) backendStatus {
+	state := b.conn.GetState()
+	result := backendStatus{State: state.String(), Breaker: b.opts.Breaker.State(), Optional: b.opts.Optional}
+	if result.Breaker == breakerOpen {
+		result.Error = "circuit breaker is open"
+		return result
+	}
+
+	switch state {
+	case connectivity.Ready, connectivity.Idle:
+	default:
+		result.Error = "connection is " + state.String()
+		return result
+	}
+
+	if b.opts.HealthCheck {
+		resp, err := healthpb.NewHealthClient(b.conn).Check(ctx,
+			&healthpb.HealthCheckRequest{Service: b.opts.Service},
+		)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+
+		if resp.Status != healthpb.HealthCheckResponse_SERVING {
+			result.Error = "backend is " + resp.Status.String()
+			return result
+		}
+	}
+
+	result.Healthy = true
+	return result
+}
+
+func (s *Server) healthz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"Status":"ok"}`))
+	}
+}
+
+func (s *Server) readyz() http.HandlerFunc {
+	type response struct {
+		Status   string
+		Backends map[string]backendStatus
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), s.httpConfig.ReadinessTimeout)
+		defer cancel()
+
+		resp := response{"ok", make(map[string]backendStatus, len(s.backends))}
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, b := range s.backends {
+			wg.Add(1)
+			go func(b backend) {
+				defer wg.Done()
+				st := b.check(ctx)
+
+				mu.Lock()
+				resp.Backends[b.name] = st
+				mu.Unlock()
+			}(b)
+		}
+		wg.Wait()
+
+		code := http.StatusOK
+		for _, st := range resp.Backends {
+			if !st.Healthy && !st.Optional {
+				code = http.StatusServiceUnavailable
+			}
+		}
+
+		if code != http.StatusOK {
+			resp.Status = "unavailable"
+		}
+
+		json, err := json.Marshal(resp)
+		if err != nil {
+			handleRPCError(w, r, err)
+			return
+		}
+
+		w.WriteHeader(code)
+		w.Write(json)
+	}
+}
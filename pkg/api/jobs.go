@@ -0,0 +1,174 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	cascadeRunning   = "running"
+	cascadeSucceeded = "succeeded"
+	cascadeFailed    = "failed"
+
+	cascadeDeletePost     = "delete-post"
+	cascadeDeleteCategory = "delete-category"
+	cascadeDeleteAccount  = "delete-account"
+)
+
+// cascadeStep is the last known state of a single job of a cascade
+type cascadeStep struct {
+	JobID     string `json:"job_id"`
+	Queue     string `json:"queue"`
+	UID       string `json:"uid"`
+	State     string `json:"state"`
+	Attempts  int    `json:"attempts,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// cascade is a group of background jobs which together carry out a single
+// user request, e.g. deletion of a post with its stats and comments
+type cascade struct {
+	ID         string        `json:"id"`
+	Kind       string        `json:"kind"`
+	UID        string        `json:"uid"`
+	UserUID    string        `json:"user_uid"`
+	CreatedAt  time.Time     `json:"created_at"`
+	FinishedAt time.Time     `json:"finished_at"`
+	Steps      []cascadeStep `json:"steps"`
+}
+
+func newCascade(kind, uid, userUID string) cascade {
+	return cascade{ID: uuid.New().String(), Kind: kind, UID: uid, UserUID: userUID, CreatedAt: time.Now()}
+}
+
+// status returns overall state of the cascade
+func (c *cascade) status() string {
+	failed := false
+	for _, step := range c.Steps {
+		switch step.State {
+		case jobStateWaiting, jobStateQueued, jobStateInFlight:
+			return cascadeRunning
+		case jobStateDead, jobStateDiscarded:
+			failed = true
+		}
+	}
+
+	if failed {
+		return cascadeFailed
+	}
+
+	return cascadeSucceeded
+}
+
+// finished reports whether no step of the cascade will run again without an
+// admin replaying it
+func (c *cascade) finished() bool {
+	for _, step := range c.Steps {
+		switch step.State {
+		case jobStateWaiting, jobStateQueued, jobStateInFlight, jobStateDead:
+			return false
+		}
+	}
+
+	return true
+}
+
+// startCascade durably records cascade c with its first jobs and hands them to
+// the workers. Jobs in last wait until every other job of the cascade, including
+// the ones its jobs enqueue later, has succeeded.
+func (s *Server) startCascade(ctx context.Context, c cascade, reqs []workerRequest, last ...workerRequest) error {
+	setRequestID(ctx, reqs)
+	setRequestID(ctx, last)
+	for i := range reqs {
+		reqs[i].cascadeID = c.ID
+	}
+	for i := range last {
+		last[i].cascadeID = c.ID
+	}
+
+	if err := s.outbox.addCascade(c, reqs, last); err != nil {
+		return err
+	}
+
+	for _, req := range reqs {
+		s.queues[req.queue].push(req)
+	}
+
+	return nil
+}
+
+// acceptCascade answers a request which started cascade c
+func acceptCascade(w http.ResponseWriter, r *http.Request, c cascade) {
+	type response struct {
+		ID string
+	}
+
+	json, err := json.Marshal(response{c.ID})
+	if err != nil {
+		handleRPCError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", "/api/jobs/"+c.ID)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(json)
+}
+
+func (s *Server) getJob() http.HandlerFunc {
+	type step struct {
+		Queue     string
+		UID       string
+		State     string
+		Attempts  int
+		LastError string
+	}
+
+	type response struct {
+		ID         string
+		Kind       string
+		UID        string
+		Status     string
+		CreatedAt  time.Time
+		FinishedAt *time.Time `json:",omitempty"`
+		Steps      []step
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		c, ok := s.outbox.cascade(id)
+		if !ok {
+			writeError(w, r, http.StatusNotFound, "")
+			return
+		}
+
+		steps := make([]step, len(c.Steps))
+		for i, cs := range c.Steps {
+			if cs.State == jobStateQueued && s.queues[cs.Queue] != nil && s.queues[cs.Queue].isInFlight(cs.JobID) {
+				cs.State = jobStateInFlight
+			}
+			c.Steps[i] = cs
+			steps[i] = step{cs.Queue, cs.UID, cs.State, cs.Attempts, cs.LastError}
+		}
+
+		resp := response{c.ID, c.Kind, c.UID, c.status(), c.CreatedAt, nil, steps}
+		if c.finished() {
+			resp.FinishedAt = &c.FinishedAt
+		}
+
+		json, err := json.Marshal(resp)
+		if err != nil {
+			handleRPCError(w, r, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write(json)
+	}
+}
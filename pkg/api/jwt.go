@@ -0,0 +1,369 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ed25519"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// jwksMinRefresh limits how often a token signed by an unknown key makes the
+// gateway fetch the JWKS document again
+const jwksMinRefresh = time.Second * 30
+
+// revocationRetention is how long tokens issued before revocation of their
+// user's tokens are rejected, it should exceed lifetime of access tokens
+const revocationRetention = time.Hour * 24
+
+// JWTConfig controls local verification of signed access tokens. Tokens which
+// aren't JWTs or are signed by unknown keys are checked by the user service.
+type JWTConfig struct {
+	// KeysFile is a JWKS document or PEM public keys, it is reloaded when
+	// it changes or the process receives SIGHUP
+	KeysFile string
+	// JWKSURL is fetched every JWKSRefresh and when a token names an
+	// unknown key
+	JWKSURL     string
+	JWKSRefresh time.Duration
+	// Issuer and Audience are required in tokens when set
+	Issuer   string
+	Audience string
+	// ClockSkew is tolerated when checking expiry and not-before times
+	ClockSkew time.Duration
+}
+
+// Enabled reports whether keys are configured
+func (c JWTConfig) Enabled() bool {
+	return c.KeysFile != "" || c.JWKSURL != ""
+}
+
+// jwtAlgorithms are the accepted signature algorithms
+var jwtAlgorithms = map[string]bool{
+	string(jose.RS256): true,
+	string(jose.ES256): true,
+	string(jose.EdDSA): true,
+}
+
+var (
+	// errNotJWT is returned for opaque tokens
+	errNotJWT = errors.New("token is not a JWT")
+	// errUnknownKey is returned for tokens signed by a key the gateway
+	// doesn't have yet
+	errUnknownKey = errors.New("token is signed by unknown key")
+)
+
+// tokenClaims are claims of access tokens besides the registered ones
+type tokenClaims struct {
+	Admin    bool   `json:"admin"`
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope"`
+}
+
+// tokenVerifier verifies access tokens with public keys of the issuer
+type tokenVerifier struct {
+	conf   JWTConfig
+	file   *fileReloader
+	client *http.Client
+
+	mu        sync.RWMutex
+	fileKeys  []jose.JSONWebKey
+	urlKeys   []jose.JSONWebKey
+	fetched   time.Time
+	refresh   chan struct{}
+	revokedMu sync.Mutex
+	revoked   map[string]time.Time
+}
+
+func newTokenVerifier(c JWTConfig) (*tokenVerifier, error) {
+	v := &tokenVerifier{
+		conf:    c,
+		client:  &http.Client{Timeout: time.Second * 10},
+		refresh: make(chan struct{}, 1),
+		revoked: make(map[string]time.Time),
+	}
+
+	if c.KeysFile != "" {
+		v.file = &fileReloader{name: "token keys", paths: []string{c.KeysFile}, load: v.loadFile}
+		if err := v.file.reload(); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.JWKSURL != "" {
+		// The user service is the fallback, so the gateway may start while
+		// the document is unavailable
+		if err := v.fetch(context.Background()); err != nil {
+			log.WithError(err).WithField("url", c.JWKSURL).Warn("can't fetch JWKS, tokens will be checked by the user service")
+		}
+	}
+
+	return v, nil
+}
+
+// loadFile reads JWKS document or PEM public keys from the keys file
+func (v *tokenVerifier) loadFile() error {
+	data, err := ioutil.ReadFile(v.conf.KeysFile)
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseKeys(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", v.conf.KeysFile, err)
+	}
+
+	v.mu.Lock()
+	v.fileKeys = keys
+	v.mu.Unlock()
+	return nil
+}
+
+// parseKeys parses JWKS document or PEM public keys
+func parseKeys(data []byte) ([]jose.JSONWebKey, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var set jose.JSONWebKeySet
+		if err := json.Unmarshal(trimmed, &set); err != nil {
+			return nil, err
+		}
+
+		return set.Keys, nil
+	}
+
+	var keys []jose.JSONWebKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, jose.JSONWebKey{Key: key})
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no public keys found")
+	}
+
+	return keys, nil
+}
+
+// fetch downloads the JWKS document
+func (v *tokenVerifier) fetch(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodGet, v.conf.JWKSURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := v.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var set jose.JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	v.urlKeys = set.Keys
+	v.fetched = time.Now()
+	v.mu.Unlock()
+	return nil
+}
+
+// watch keeps keys up to date until ctx is done
+func (v *tokenVerifier) watch(ctx context.Context) {
+	if v.file != nil {
+		go v.file.watch(ctx)
+	}
+
+	if v.conf.JWKSURL == "" {
+		return
+	}
+
+	ticker := time.NewTicker(v.conf.JWKSRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-v.refresh:
+			v.mu.RLock()
+			recent := time.Since(v.fetched) < jwksMinRefresh
+			v.mu.RUnlock()
+			if recent {
+				continue
+			}
+		}
+
+		if err := v.fetch(ctx); err != nil {
+			log.WithError(err).WithField("url", v.conf.JWKSURL).Error("can't fetch JWKS, keeping the previous keys")
+			continue
+		}
+		log.WithField("url", v.conf.JWKSURL).Info("fetched JWKS")
+	}
+}
+
+// candidates returns keys which may have signed token with header h
+func (v *tokenVerifier) candidates(h jose.Header) []jose.JSONWebKey {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	var keys []jose.JSONWebKey
+	for _, k := range append(v.fileKeys[:len(v.fileKeys):len(v.fileKeys)], v.urlKeys...) {
+		if h.KeyID != "" && k.KeyID != "" && k.KeyID != h.KeyID {
+			continue
+		}
+
+		if (k.Algorithm != "" && k.Algorithm != h.Algorithm) || k.Use == "enc" || !keyFits(k.Key, h.Algorithm) {
+			continue
+		}
+
+		keys = append(keys, k)
+	}
+
+	return keys
+}
+
+// keyFits reports whether key can verify signatures made with algorithm alg
+func keyFits(key interface{}, alg string) bool {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return alg == string(jose.RS256)
+	case *ecdsa.PublicKey:
+		return alg == string(jose.ES256)
+	case ed25519.PublicKey:
+		return alg == string(jose.EdDSA)
+	default:
+		return false
+	}
+}
+
+// revoke rejects tokens of user uid issued until now
+func (v *tokenVerifier) revoke(uid string) {
+	v.revokedMu.Lock()
+	defer v.revokedMu.Unlock()
+
+	now := time.Now()
+	v.revoked[uid] = now
+	for u, at := range v.revoked {
+		if now.Sub(at) > revocationRetention {
+			delete(v.revoked, u)
+		}
+	}
+}
+
+func (v *tokenVerifier) isRevoked(uid string, issued time.Time) bool {
+	v.revokedMu.Lock()
+	defer v.revokedMu.Unlock()
+
+	at, ok := v.revoked[uid]
+	return ok && !issued.After(at)
+}
+
+// verify checks signature and claims of token, it returns errNotJWT and
+// errUnknownKey for tokens it can't judge
+func (v *tokenVerifier) verify(token string) (*Principal, time.Time, error) {
+	tok, err := jwt.ParseSigned(token)
+	if err != nil || len(tok.Headers) != 1 {
+		return nil, time.Time{}, errNotJWT
+	}
+
+	h := tok.Headers[0]
+	if !jwtAlgorithms[h.Algorithm] {
+		return nil, time.Time{}, fmt.Errorf("algorithm %q is not accepted", h.Algorithm)
+	}
+
+	keys := v.candidates(h)
+	if len(keys) == 0 {
+		select {
+		case v.refresh <- struct{}{}:
+		default:
+		}
+		return nil, time.Time{}, errUnknownKey
+	}
+
+	var claims jwt.Claims
+	var extra tokenClaims
+	err = errors.New("signature is invalid")
+	for _, k := range keys {
+		if err = tok.Claims(k.Key, &claims, &extra); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	expected := jwt.Expected{Issuer: v.conf.Issuer, Time: time.Now()}
+	if v.conf.Audience != "" {
+		expected.Audience = jwt.Audience{v.conf.Audience}
+	}
+	if err := claims.ValidateWithLeeway(expected, v.conf.ClockSkew); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	if claims.Subject == "" || claims.Expiry == nil {
+		return nil, time.Time{}, errors.New("token has no subject or expiry")
+	}
+
+	var issued time.Time
+	if claims.IssuedAt != nil {
+		issued = claims.IssuedAt.Time()
+	}
+	if v.isRevoked(claims.Subject, issued) {
+		return nil, time.Time{}, errors.New("token is revoked")
+	}
+
+	p := &Principal{
+		UID:    claims.Subject,
+		Admin:  extra.Admin,
+		AppID:  extra.ClientID,
+		Scopes: strings.Fields(extra.Scope),
+	}
+	return p, claims.Expiry.Time().Add(v.conf.ClockSkew), nil
+}
+
+// tokenGrant returns application and scopes written in signed token without
+// checking its signature. It may only be used for tokens which the user
+// service has accepted, opaque tokens carry neither.
+func tokenGrant(token string) (string, []string) {
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		return "", nil
+	}
+
+	var claims tokenClaims
+	if err := tok.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return "", nil
+	}
+
+	return claims.ClientID, strings.Fields(claims.Scope)
+}
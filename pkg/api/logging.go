@@ -0,0 +1,94 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	// requestIDMetadata is the gRPC metadata key carrying request ID to
+	// backends
+	requestIDMetadata = "x-request-id"
+
+	maxRequestIDLength = 128
+)
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	loggerKey
+	principalKey
+)
+
+// validRequestID reports whether id received from a client can be reused
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// withRequestID returns ctx carrying request ID and a logger which adds it to
+// every line
+func withRequestID(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, requestIDKey, id)
+	return context.WithValue(ctx, loggerKey, log.WithField("request_id", id))
+}
+
+// requestIDFrom returns request ID carried by ctx
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// logger returns logger for ctx
+func logger(ctx context.Context) *log.Entry {
+	if l, ok := ctx.Value(loggerKey).(*log.Entry); ok {
+		return l
+	}
+
+	return log.NewEntry(log.StandardLogger())
+}
+
+// requestID takes X-Request-ID of the request or assigns a new one, echoes it
+// in the response and makes it available to handlers and backends
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(withRequestID(r.Context(), id)))
+	})
+}
+
+// RequestIDInterceptor passes request ID of the call's context to the backend
+// in metadata
+func RequestIDInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if id := requestIDFrom(ctx); id != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadata, id)
+		}
+
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
@@ -0,0 +1,199 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const metricsNamespace = "rsoi_api"
+
+type metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	jobRetries      *prometheus.CounterVec
+	jobsFinished    *prometheus.CounterVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "Number of HTTP requests by route template, method and status code.",
+		}, []string{"route", "method", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests by route template, method and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "code"}),
+		jobRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "job_retries_total",
+			Help:      "Number of failed job attempts which were scheduled for retry.",
+		}, []string{"queue"}),
+		jobsFinished: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "jobs_finished_total",
+			Help:      "Number of jobs which left the queue by result.",
+		}, []string{"queue", "result"}),
+	}
+
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.jobRetries,
+		m.jobsFinished,
+	)
+
+	return m
+}
+
+// RegisterMetrics exposes additional collectors, e.g. gRPC client metrics,
+// at /metrics
+func (s *Server) RegisterMetrics(cs ...prometheus.Collector) error {
+	for _, c := range cs {
+		if err := s.metrics.registry.Register(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// statusRecorder remembers status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// instrument counts, times and logs requests by route template
+func (s *Server) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+
+		rec := &statusRecorder{w, http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+
+		elapsed := time.Since(start)
+		code := strconv.Itoa(rec.status)
+		s.metrics.requests.WithLabelValues(route, r.Method, code).Inc()
+		s.metrics.requestDuration.WithLabelValues(route, r.Method, code).Observe(elapsed.Seconds())
+
+		logger(r.Context()).WithFields(log.Fields{
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"route":       route,
+			"status":      rec.status,
+			"duration_ms": float64(elapsed) / float64(time.Millisecond),
+			"remote_addr": r.RemoteAddr,
+		}).Info("request")
+	})
+}
+
+// queueCollector reports state of the job queues at scrape time
+type queueCollector struct {
+	s *Server
+
+	depth    *prometheus.Desc
+	inFlight *prometheus.Desc
+	retrying *prometheus.Desc
+	dead     *prometheus.Desc
+}
+
+func newQueueCollector(s *Server) *queueCollector {
+	return &queueCollector{
+		s:        s,
+		depth:    prometheus.NewDesc(metricsNamespace+"_queue_depth", "Number of jobs waiting in the queue.", []string{"queue"}, nil),
+		inFlight: prometheus.NewDesc(metricsNamespace+"_queue_in_flight", "Number of jobs being executed.", []string{"queue"}, nil),
+		retrying: prometheus.NewDesc(metricsNamespace+"_queue_retrying", "Number of waiting jobs which already failed at least once.", []string{"queue"}, nil),
+		dead:     prometheus.NewDesc(metricsNamespace+"_queue_dead_letters", "Number of jobs which ran out of attempts.", []string{"queue"}, nil),
+	}
+}
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.depth
+	ch <- c.inFlight
+	ch <- c.retrying
+	ch <- c.dead
+}
+
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	dead := make(map[string]int)
+	for _, req := range c.s.outbox.deadLetters() {
+		dead[req.queue]++
+	}
+
+	for _, name := range queueNames {
+		queued, inFlight := c.s.queues[name].list()
+		retrying := 0
+		for _, req := range queued {
+			if req.attempts > 0 {
+				retrying++
+			}
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.depth, prometheus.GaugeValue, float64(len(queued)), name)
+		ch <- prometheus.MustNewConstMetric(c.inFlight, prometheus.GaugeValue, float64(len(inFlight)), name)
+		ch <- prometheus.MustNewConstMetric(c.retrying, prometheus.GaugeValue, float64(retrying), name)
+		ch <- prometheus.MustNewConstMetric(c.dead, prometheus.GaugeValue, float64(dead[name]), name)
+	}
+}
+
+// breakerCollector reports state of circuit breakers at scrape time
+type breakerCollector struct {
+	s *Server
+
+	state    *prometheus.Desc
+	rejected *prometheus.Desc
+}
+
+func newBreakerCollector(s *Server) *breakerCollector {
+	return &breakerCollector{
+		s:        s,
+		state:    prometheus.NewDesc(metricsNamespace+"_circuit_breaker_state", "State of the circuit breaker of a backend: 0 closed, 1 half-open, 2 open.", []string{"backend"}, nil),
+		rejected: prometheus.NewDesc(metricsNamespace+"_circuit_breaker_rejected_total", "Number of calls failed fast by the circuit breaker of a backend.", []string{"backend"}, nil),
+	}
+}
+
+func (c *breakerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.state
+	ch <- c.rejected
+}
+
+func (c *breakerCollector) Collect(ch chan<- prometheus.Metric) {
+	states := map[string]float64{breakerClosed: 0, breakerHalfOpen: 1, breakerOpen: 2}
+	for _, b := range c.s.backends {
+		if b.opts.Breaker == nil {
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.state, prometheus.GaugeValue, states[b.opts.Breaker.State()], b.name)
+		ch <- prometheus.MustNewConstMetric(c.rejected, prometheus.CounterValue, float64(b.opts.Breaker.rejectedCalls()), b.name)
+	}
+}
+
+func (s *Server) metricsHandler() http.Handler {
+	return promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{})
+}
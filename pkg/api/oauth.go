@@ -0,0 +1,303 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	user "github.com/andreymgn/RSOI-user/pkg/user/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Error codes of the token endpoint, see RFC 6749 section 5.2
+const (
+	oauthInvalidRequest       = "invalid_request"
+	oauthInvalidClient        = "invalid_client"
+	oauthInvalidGrant         = "invalid_grant"
+	oauthUnsupportedGrantType = "unsupported_grant_type"
+)
+
+// oauthError is the body of error responses of the token endpoint
+type oauthError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// tokenResponse is the body of successful responses of the token endpoint
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// clientCredentials identify the OAuth application making the request
+type clientCredentials struct {
+	ID     string
+	Secret string
+}
+
+// noStore forbids caching of responses carrying tokens
+func noStore(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+}
+
+func writeOAuthError(w http.ResponseWriter, r *http.Request, code, description string) {
+	status := http.StatusBadRequest
+	if code == oauthInvalidClient {
+		status = http.StatusUnauthorized
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+
+	logger(r.Context()).WithField("error", code).Info("token request rejected: " + description)
+	body, _ := json.Marshal(oauthError{code, description})
+	noStore(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// handleOAuthRPCError responds with err returned by the user service, errors
+// caused by the request are reported in the form the RFC requires
+func handleOAuthRPCError(w http.ResponseWriter, r *http.Request, err error) {
+	switch st := status.Convert(err); st.Code() {
+	case codes.Unauthenticated, codes.PermissionDenied:
+		writeOAuthError(w, r, oauthInvalidClient, "client authentication failed")
+	case codes.NotFound, codes.InvalidArgument, codes.FailedPrecondition:
+		writeOAuthError(w, r, oauthInvalidGrant, st.Message())
+	default:
+		handleRPCError(w, r, err)
+	}
+}
+
+// clientAuth returns credentials of the client from HTTP Basic authentication
+// or from the form, using both at once is an error
+func clientAuth(r *http.Request) (clientCredentials, bool) {
+	formID, formSecret := r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		return clientCredentials{ID: formID, Secret: formSecret}, true
+	}
+
+	if formSecret != "" {
+		return clientCredentials{}, false
+	}
+
+	// Credentials are form-encoded before they are put into the header
+	var err error
+	if id, err = url.QueryUnescape(id); err != nil {
+		return clientCredentials{}, false
+	}
+	if secret, err = url.QueryUnescape(secret); err != nil {
+		return clientCredentials{}, false
+	}
+	if formID != "" && formID != id {
+		return clientCredentials{}, false
+	}
+
+	return clientCredentials{id, secret}, true
+}
+
+// checkClient authenticates client with the user service. It responds with
+// invalid_client and returns false if the credentials are wrong.
+func (s *Server) checkClient(w http.ResponseWriter, r *http.Request, client clientCredentials) bool {
+	if client.ID == "" || client.Secret == "" {
+		writeOAuthError(w, r, oauthInvalidClient, "client authentication is required")
+		return false
+	}
+
+	_, err := s.userClient.client.CheckAppSecret(r.Context(),
+		&user.CheckAppSecretRequest{AppUid: client.ID, AppSecret: client.Secret},
+	)
+	switch status.Code(err) {
+	case codes.OK:
+		return true
+	case codes.Unauthenticated, codes.PermissionDenied, codes.NotFound:
+		writeOAuthError(w, r, oauthInvalidClient, "client authentication failed")
+	default:
+		handleRPCError(w, r, err)
+	}
+
+	return false
+}
+
+// expiresIn returns lifetime of access token in seconds. Signed tokens carry
+// their expiry, for opaque ones the configured lifetime is assumed.
+func (s *Server) expiresIn(token string) int64 {
+	if tok, err := jwt.ParseSigned(token); err == nil {
+		var claims jwt.Claims
+		if tok.UnsafeClaimsWithoutVerification(&claims) == nil && claims.Expiry != nil {
+			if d := time.Until(claims.Expiry.Time()); d > 0 {
+				return int64(d.Seconds())
+			}
+		}
+	}
+
+	return int64(s.httpConfig.Auth.AccessTokenTTL.Seconds())
+}
+
+// grantedScope returns scope of access token, it is the requested one unless
+// the token says otherwise
+func grantedScope(token, requested string) string {
+	if _, scopes := tokenGrant(token); len(scopes) > 0 {
+		return strings.Join(scopes, " ")
+	}
+
+	return requested
+}
+
+// oauthToken is the token endpoint of RFC 6749. It accepts form-encoded
+// requests with authorization_code, refresh_token and client_credentials
+// grants.
+func (s *Server) oauthToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+			writeOAuthError(w, r, oauthInvalidRequest, "body must be application/x-www-form-urlencoded")
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			writeOAuthError(w, r, oauthInvalidRequest, err.Error())
+			return
+		}
+
+		for name, values := range r.PostForm {
+			if len(values) > 1 {
+				writeOAuthError(w, r, oauthInvalidRequest, "parameter "+name+" is repeated")
+				return
+			}
+		}
+
+		if r.URL.Query().Get("client_secret") != "" {
+			writeOAuthError(w, r, oauthInvalidRequest, "client_secret must not be sent in the URL")
+			return
+		}
+
+		client, ok := clientAuth(r)
+		if !ok {
+			writeOAuthError(w, r, oauthInvalidRequest, "client credentials are malformed or sent in more than one way")
+			return
+		}
+
+		var resp tokenResponse
+		switch grant := r.PostForm.Get("grant_type"); grant {
+		case "authorization_code":
+			resp, ok = s.authorizationCodeGrant(w, r, client)
+		case "refresh_token":
+			resp, ok = s.refreshTokenGrant(w, r, client)
+		case "client_credentials":
+			resp, ok = s.clientCredentialsGrant(w, r, client)
+		case "":
+			writeOAuthError(w, r, oauthInvalidRequest, "grant_type is required")
+			return
+		default:
+			writeOAuthError(w, r, oauthUnsupportedGrantType, "grant type "+grant+" is not supported")
+			return
+		}
+		if !ok {
+			return
+		}
+
+		resp.TokenType = "Bearer"
+		resp.ExpiresIn = s.expiresIn(resp.AccessToken)
+		resp.Scope = grantedScope(resp.AccessToken, r.PostForm.Get("scope"))
+
+		json, err := json.Marshal(resp)
+		if err != nil {
+			handleRPCError(w, r, err)
+			return
+		}
+
+		noStore(w)
+		w.WriteHeader(http.StatusOK)
+		w.Write(json)
+	}
+}
+
+func (s *Server) authorizationCodeGrant(w http.ResponseWriter, r *http.Request, client clientCredentials) (tokenResponse, bool) {
+	code := r.PostForm.Get("code")
+	if code == "" {
+		writeOAuthError(w, r, oauthInvalidRequest, "code is required")
+		return tokenResponse{}, false
+	}
+
+	if client.ID == "" || client.Secret == "" {
+		writeOAuthError(w, r, oauthInvalidClient, "client authentication is required")
+		return tokenResponse{}, false
+	}
+
+	getTokenResponse, err := s.userClient.client.GetTokenFromCode(r.Context(),
+		&user.GetTokenFromCodeRequest{Code: code, AppUid: client.ID, AppSecret: client.Secret},
+	)
+	if err != nil {
+		handleOAuthRPCError(w, r, err)
+		return tokenResponse{}, false
+	}
+
+	return tokenResponse{
+		AccessToken:  getTokenResponse.AccessToken,
+		RefreshToken: getTokenResponse.RefreshToken,
+	}, true
+}
+
+// refreshTokenGrant exchanges refresh token for a new pair of tokens, the
+// client must authenticate
+func (s *Server) refreshTokenGrant(w http.ResponseWriter, r *http.Request, client clientCredentials) (tokenResponse, bool) {
+	refreshToken := r.PostForm.Get("refresh_token")
+	if refreshToken == "" {
+		writeOAuthError(w, r, oauthInvalidRequest, "refresh_token is required")
+		return tokenResponse{}, false
+	}
+
+	if !s.checkClient(w, r, client) {
+		return tokenResponse{}, false
+	}
+
+	ctx := r.Context()
+	refreshTokenResponse, err := s.userClient.client.RefreshAccessToken(ctx,
+		&user.RefreshAccessTokenRequest{RefreshToken: refreshToken},
+	)
+	if err != nil {
+		if c := status.Code(err); c == codes.Unauthenticated || c == codes.PermissionDenied {
+			// Here these mean the refresh token is invalid, not the client
+			writeOAuthError(w, r, oauthInvalidGrant, "refresh token is invalid, expired or revoked")
+			return tokenResponse{}, false
+		}
+		handleOAuthRPCError(w, r, err)
+		return tokenResponse{}, false
+	}
+
+	s.forgetTokensOf(ctx, refreshTokenResponse.AccessToken)
+
+	return tokenResponse{AccessToken: refreshTokenResponse.AccessToken, RefreshToken: refreshTokenResponse.RefreshToken}, true
+}
+
+// clientCredentialsGrant issues a token to the client itself, no refresh
+// token is issued with it
+func (s *Server) clientCredentialsGrant(w http.ResponseWriter, r *http.Request, client clientCredentials) (tokenResponse, bool) {
+	if client.ID == "" || client.Secret == "" {
+		writeOAuthError(w, r, oauthInvalidClient, "client authentication is required")
+		return tokenResponse{}, false
+	}
+
+	getAppTokenResponse, err := s.userClient.client.GetAppToken(r.Context(),
+		&user.GetAppTokenRequest{AppUid: client.ID, AppSecret: client.Secret, Scope: r.PostForm.Get("scope")},
+	)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			writeOAuthError(w, r, oauthInvalidClient, "client authentication failed")
+			return tokenResponse{}, false
+		}
+		handleOAuthRPCError(w, r, err)
+		return tokenResponse{}, false
+	}
+
+	return tokenResponse{AccessToken: getAppTokenResponse.AccessToken}, true
+}
@@ -0,0 +1,669 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	outboxOpAdd   = "add"
+	outboxOpRetry = "retry"
+	outboxOpDead  = "dead"
+	outboxOpDone  = "done"
+	// outboxOpHold records a job which waits for the rest of its cascade
+	outboxOpHold = "hold"
+
+	outboxOpCascade = "cascade"
+
+	// outboxOpDeleted records UID deleted by a job of a tombstone queue,
+	// outboxOpForget drops the record
+	outboxOpDeleted = "deleted"
+	outboxOpForget  = "forget"
+
+	// outboxCompactThreshold is the number of stale records tolerated in the
+	// log before it is rewritten
+	outboxCompactThreshold = 1000
+
+	// cascadeRetention is how long a finished cascade can be looked up
+	cascadeRetention = time.Hour * 24
+
+	// tombstoneRetention is how long a tombstone is kept when the reconciler
+	// doesn't forget it, e.g. because it never repairs what it finds
+	tombstoneRetention = time.Hour * 24 * 7
+)
+
+// tombstoneQueues are queues whose succeeded jobs are remembered until the
+// reconciler confirms that nothing was left behind by the deletion
+var tombstoneQueues = map[string]bool{
+	deletePostQueue: true,
+}
+
+// outboxEntry is a single record of the outbox log
+type outboxEntry struct {
+	Op        string    `json:"op"`
+	ID        string    `json:"id"`
+	At        time.Time `json:"at"`
+	Queue     string    `json:"queue,omitempty"`
+	UID       string    `json:"uid,omitempty"`
+	CascadeID string    `json:"cascade_id,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Attempts  int       `json:"attempts,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+	Result    string    `json:"result,omitempty"`
+	Cascade   *cascade  `json:"cascade,omitempty"`
+}
+
+func newOutboxEntry(op string, req workerRequest) outboxEntry {
+	return outboxEntry{
+		Op:        op,
+		ID:        req.id,
+		At:        time.Now(),
+		Queue:     req.queue,
+		UID:       req.uid,
+		CascadeID: req.cascadeID,
+		RequestID: req.requestID,
+		Attempts:  req.attempts,
+		LastError: req.lastError,
+	}
+}
+
+func (e outboxEntry) request() workerRequest {
+	return workerRequest{id: e.ID, queue: e.Queue, uid: e.UID, cascadeID: e.CascadeID, requestID: e.RequestID, attempts: e.Attempts, lastError: e.LastError}
+}
+
+// outbox is a durable append-only log of background jobs. A job is written
+// to disk before the request which created it is answered and is removed only
+// after a worker has finished it, so pending jobs survive restarts. Jobs which
+// ran out of attempts are kept in the log as dead letters. Cascades group jobs
+// and keep the outcome of each of them for a while after they are finished.
+type outbox struct {
+	mu        sync.Mutex
+	path      string
+	file      *os.File
+	jobs      map[string]outboxEntry
+	dead      map[string]outboxEntry
+	held      map[string]outboxEntry
+	deleted   map[string]outboxEntry
+	order     []string
+	cascades  map[string]*cascade
+	stepIndex map[string]int
+	records   int
+	// size is the length of the log up to the last record which was
+	// written in full
+	size int64
+}
+
+// openOutbox reads the log at path, drops finished jobs from it and opens it
+// for appending
+func openOutbox(path string) (*outbox, error) {
+	o := &outbox{
+		path:      path,
+		jobs:      make(map[string]outboxEntry),
+		dead:      make(map[string]outboxEntry),
+		held:      make(map[string]outboxEntry),
+		deleted:   make(map[string]outboxEntry),
+		cascades:  make(map[string]*cascade),
+		stepIndex: make(map[string]int),
+	}
+
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err == nil {
+		// cascade records can be large, so the log is read without a line limit
+		r := bufio.NewReader(f)
+		for n := 1; ; n++ {
+			line, err := r.ReadBytes('\n')
+			if len(bytes.TrimSpace(line)) > 0 {
+				var e outboxEntry
+				if err := json.Unmarshal(line, &e); err != nil {
+					// A record torn by a crash, the ones after it are still
+					// valid. Compaction below drops it from the log.
+					log.WithError(err).WithField("path", path).WithField("line", n).Error("skipping corrupt outbox record")
+				} else {
+					o.apply(e)
+				}
+			}
+
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+
+		f.Close()
+	}
+
+	if err := o.compact(); err != nil {
+		return nil, err
+	}
+
+	// The previous run may have stopped between finishing the last step of a
+	// cascade and releasing the jobs held for it
+	for id := range o.cascades {
+		if _, err := o.release(id); err != nil {
+			return nil, err
+		}
+	}
+
+	return o, nil
+}
+
+func (o *outbox) apply(e outboxEntry) {
+	o.records++
+
+	if e.Op == outboxOpCascade {
+		if e.Cascade == nil {
+			return
+		}
+
+		c := *e.Cascade
+		c.Steps = append([]cascadeStep(nil), c.Steps...)
+		for i, step := range c.Steps {
+			o.stepIndex[step.JobID] = i
+		}
+		o.cascades[c.ID] = &c
+		return
+	}
+
+	switch e.Op {
+	case outboxOpDeleted:
+		o.deleted[e.Queue+"/"+e.UID] = e
+		return
+	case outboxOpForget:
+		delete(o.deleted, e.Queue+"/"+e.UID)
+		return
+	}
+
+	job, isJob := o.jobs[e.ID]
+	if !isJob {
+		job, isJob = o.dead[e.ID]
+	}
+	if !isJob {
+		job, isJob = o.held[e.ID]
+	}
+	if !isJob && e.Op != outboxOpDone {
+		o.order = append(o.order, e.ID)
+	}
+
+	switch e.Op {
+	case outboxOpAdd, outboxOpRetry:
+		delete(o.dead, e.ID)
+		delete(o.held, e.ID)
+		o.jobs[e.ID] = e
+		o.updateStep(e, jobStateQueued)
+	case outboxOpHold:
+		o.held[e.ID] = e
+		o.updateStep(e, jobStateWaiting)
+	case outboxOpDead:
+		delete(o.jobs, e.ID)
+		o.dead[e.ID] = e
+		o.updateStep(e, jobStateDead)
+	case outboxOpDone:
+		delete(o.jobs, e.ID)
+		delete(o.dead, e.ID)
+		delete(o.held, e.ID)
+		if isJob {
+			result := e.Result
+			if result == "" {
+				result = jobStateSucceeded
+			}
+
+			job.At = e.At
+			o.updateStep(job, result)
+
+			if result == jobStateSucceeded && tombstoneQueues[job.Queue] {
+				o.deleted[job.Queue+"/"+job.UID] = outboxEntry{Op: outboxOpDeleted, At: e.At, Queue: job.Queue, UID: job.UID}
+			}
+		}
+	}
+}
+
+// updateStep records state of job in the cascade it belongs to
+func (o *outbox) updateStep(e outboxEntry, state string) {
+	c, ok := o.cascades[e.CascadeID]
+	if !ok {
+		return
+	}
+
+	step := cascadeStep{e.ID, e.Queue, e.UID, state, e.Attempts, e.LastError}
+	if i, ok := o.stepIndex[e.ID]; ok && i < len(c.Steps) && c.Steps[i].JobID == e.ID {
+		c.Steps[i] = step
+	} else {
+		o.stepIndex[e.ID] = len(c.Steps)
+		c.Steps = append(c.Steps, step)
+	}
+
+	if c.finished() {
+		c.FinishedAt = e.At
+	} else {
+		c.FinishedAt = time.Time{}
+	}
+}
+
+// compact rewrites the log so that it contains only pending, held and dead
+// jobs, retained cascades and tombstones
+func (o *outbox) compact() error {
+	tmpPath := o.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	cascades := make([]*cascade, 0, len(o.cascades))
+	for id, c := range o.cascades {
+		if c.finished() && time.Since(c.FinishedAt) > cascadeRetention {
+			for _, step := range c.Steps {
+				delete(o.stepIndex, step.JobID)
+			}
+			delete(o.cascades, id)
+			continue
+		}
+
+		cascades = append(cascades, c)
+	}
+	sort.Slice(cascades, func(i, j int) bool { return cascades[i].CreatedAt.Before(cascades[j].CreatedAt) })
+
+	order := make([]string, 0, len(o.jobs)+len(o.dead)+len(o.held))
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, c := range cascades {
+		if err := enc.Encode(outboxEntry{Op: outboxOpCascade, ID: c.ID, At: c.CreatedAt, Cascade: c}); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	deleted := make([]outboxEntry, 0, len(o.deleted))
+	for key, e := range o.deleted {
+		if time.Since(e.At) > tombstoneRetention {
+			delete(o.deleted, key)
+			continue
+		}
+
+		deleted = append(deleted, e)
+	}
+	sort.Slice(deleted, func(i, j int) bool { return deleted[i].At.Before(deleted[j].At) })
+	for _, e := range deleted {
+		if err := enc.Encode(e); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	for _, id := range o.order {
+		e, ok := o.jobs[id]
+		if !ok {
+			e, ok = o.dead[id]
+		}
+		if !ok {
+			e, ok = o.held[id]
+		}
+
+		if !ok {
+			continue
+		}
+
+		if err := enc.Encode(e); err != nil {
+			tmp.Close()
+			return err
+		}
+		order = append(order, id)
+	}
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if o.file != nil {
+		o.file.Close()
+	}
+
+	if err := os.Rename(tmpPath, o.path); err != nil {
+		return err
+	}
+
+	o.file, err = os.OpenFile(o.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	fi, err := o.file.Stat()
+	if err != nil {
+		return err
+	}
+	o.size = fi.Size()
+
+	o.order = order
+	o.records = len(order) + len(cascades) + len(deleted)
+	return nil
+}
+
+// write appends entries to the log and flushes them to disk. Entries are
+// applied only once they are durable, a failed write is cut off the log so
+// that records written after it stay readable.
+func (o *outbox) write(entries ...outboxEntry) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+
+	if _, err := o.file.Write(buf.Bytes()); err != nil {
+		o.discardTail()
+		return err
+	}
+
+	if err := o.file.Sync(); err != nil {
+		o.discardTail()
+		return err
+	}
+
+	o.size += int64(buf.Len())
+	for _, e := range entries {
+		o.apply(e)
+	}
+
+	if o.records > 2*(len(o.jobs)+len(o.dead)+len(o.held)+len(o.cascades)+len(o.deleted))+outboxCompactThreshold {
+		return o.compact()
+	}
+
+	return nil
+}
+
+// discardTail removes whatever a failed write left after the last complete
+// record. If the log can't be truncated it is rewritten from memory.
+func (o *outbox) discardTail() {
+	err := o.file.Truncate(o.size)
+	if err == nil {
+		err = o.file.Sync()
+	}
+	if err == nil {
+		return
+	}
+
+	log.WithError(err).WithField("path", o.path).Error("can't truncate outbox after failed write, compacting it")
+	if err := o.compact(); err != nil {
+		log.WithError(err).WithField("path", o.path).Error("can't compact outbox")
+	}
+}
+
+// add durably records new jobs
+func (o *outbox) add(jobs ...workerRequest) error {
+	entries := make([]outboxEntry, len(jobs))
+	for i, job := range jobs {
+		entries[i] = newOutboxEntry(outboxOpAdd, job)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.write(entries...)
+}
+
+// addCascade durably records new cascade together with its first jobs and
+// the ones held until the rest of the cascade succeeds
+func (o *outbox) addCascade(c cascade, jobs, last []workerRequest) error {
+	entries := make([]outboxEntry, 0, len(jobs)+len(last)+1)
+	entries = append(entries, outboxEntry{Op: outboxOpCascade, ID: c.ID, At: c.CreatedAt, Cascade: &c})
+	for _, job := range jobs {
+		entries = append(entries, newOutboxEntry(outboxOpAdd, job))
+	}
+	for _, job := range last {
+		entries = append(entries, newOutboxEntry(outboxOpHold, job))
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.write(entries...)
+}
+
+// retry records a failed attempt of job
+func (o *outbox) retry(job workerRequest) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.write(newOutboxEntry(outboxOpRetry, job))
+}
+
+// bury moves job to the dead letters
+func (o *outbox) bury(job workerRequest) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.write(newOutboxEntry(outboxOpDead, job))
+}
+
+// done removes job from the log, result is recorded in the job's cascade. It
+// returns held jobs of the cascade which became due, they are already
+// recorded as pending.
+func (o *outbox) done(id, result string) ([]workerRequest, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	job, ok := o.jobs[id]
+	if !ok {
+		job, ok = o.dead[id]
+	}
+	if !ok {
+		job = o.held[id]
+	}
+
+	if err := o.write(outboxEntry{Op: outboxOpDone, ID: id, At: time.Now(), Result: result}); err != nil {
+		return nil, err
+	}
+
+	return o.release(job.CascadeID)
+}
+
+// release turns held jobs of cascade id into pending ones once every other
+// step of the cascade has succeeded. If any step was discarded the held jobs
+// are discarded too, running them would orphan what that step left behind.
+func (o *outbox) release(id string) ([]workerRequest, error) {
+	c, ok := o.cascades[id]
+	if !ok {
+		return nil, nil
+	}
+
+	var held []outboxEntry
+	discarded := false
+	for _, step := range c.Steps {
+		switch step.State {
+		case jobStateWaiting:
+			if e, ok := o.held[step.JobID]; ok {
+				held = append(held, e)
+			}
+		case jobStateSucceeded:
+		case jobStateDiscarded:
+			discarded = true
+		default:
+			return nil, nil
+		}
+	}
+
+	if len(held) == 0 {
+		return nil, nil
+	}
+
+	entries := make([]outboxEntry, len(held))
+	if discarded {
+		for i, e := range held {
+			entries[i] = outboxEntry{Op: outboxOpDone, ID: e.ID, At: time.Now(), Result: jobStateDiscarded}
+		}
+		return nil, o.write(entries...)
+	}
+
+	reqs := make([]workerRequest, len(held))
+	for i, e := range held {
+		reqs[i] = e.request()
+		reqs[i].doneTime = time.Now()
+		entries[i] = newOutboxEntry(outboxOpAdd, reqs[i])
+	}
+
+	if err := o.write(entries...); err != nil {
+		return nil, err
+	}
+
+	return reqs, nil
+}
+
+// pending returns unfinished jobs in the order they were added
+func (o *outbox) pending() []workerRequest {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	result := make([]workerRequest, 0, len(o.jobs))
+	for _, id := range o.order {
+		if e, ok := o.jobs[id]; ok {
+			result = append(result, e.request())
+		}
+	}
+
+	return result
+}
+
+// deadLetters returns jobs which ran out of attempts
+func (o *outbox) deadLetters() []workerRequest {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	result := make([]workerRequest, 0, len(o.dead))
+	for _, id := range o.order {
+		if e, ok := o.dead[id]; ok {
+			result = append(result, e.request())
+		}
+	}
+
+	return result
+}
+
+// deadLetter returns dead-lettered job by id
+func (o *outbox) deadLetter(id string) (workerRequest, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	e, ok := o.dead[id]
+	return e.request(), ok
+}
+
+// job returns unfinished job by id, whether it is pending, dead-lettered or
+// held
+func (o *outbox) job(id string) (workerRequest, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	e, ok := o.jobs[id]
+	if !ok {
+		e, ok = o.dead[id]
+	}
+	if !ok {
+		e, ok = o.held[id]
+	}
+
+	return e.request(), ok
+}
+
+// pendingUIDs returns set of UIDs which have unfinished jobs in queue
+func (o *outbox) pendingUIDs(queue string) map[string]bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	result := make(map[string]bool)
+	for _, e := range o.jobs {
+		if e.Queue == queue {
+			result[e.UID] = true
+		}
+	}
+
+	for _, e := range o.dead {
+		if e.Queue == queue {
+			result[e.UID] = true
+		}
+	}
+
+	for _, e := range o.held {
+		if e.Queue == queue {
+			result[e.UID] = true
+		}
+	}
+
+	return result
+}
+
+// deletedUIDs returns UIDs deleted by jobs in tombstone queue which haven't
+// been forgotten or expired yet
+func (o *outbox) deletedUIDs(queue string) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var result []string
+	for _, e := range o.deleted {
+		if e.Queue == queue && time.Since(e.At) <= tombstoneRetention {
+			result = append(result, e.UID)
+		}
+	}
+	sort.Strings(result)
+
+	return result
+}
+
+// forgetDeleted drops tombstone of uid deleted by a job in queue
+func (o *outbox) forgetDeleted(queue, uid string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, ok := o.deleted[queue+"/"+uid]; !ok {
+		return nil
+	}
+
+	return o.write(outboxEntry{Op: outboxOpForget, At: time.Now(), Queue: queue, UID: uid})
+}
+
+// cascade returns a copy of cascade by id
+func (o *outbox) cascade(id string) (cascade, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	c, ok := o.cascades[id]
+	if !ok {
+		return cascade{}, false
+	}
+
+	result := *c
+	result.Steps = append([]cascadeStep(nil), c.Steps...)
+	return result, true
+}
+
+func (o *outbox) close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.file.Close()
+}
@@ -0,0 +1,267 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempOutbox(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filepath.Join(dir, "outbox.log"), func() { os.RemoveAll(dir) }
+}
+
+func pendingUIDList(o *outbox) []string {
+	var uids []string
+	for _, job := range o.pending() {
+		uids = append(uids, job.uid)
+	}
+
+	return uids
+}
+
+func TestOutboxSkipsCorruptRecords(t *testing.T) {
+	path, cleanup := tempOutbox(t)
+	defer cleanup()
+
+	o, err := openOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.add(newWorkerRequest(deletePostQueue, "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A torn record in the middle of the log followed by an acknowledged one
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"add","id":"torn","que` + "\n")
+	f.Close()
+	if err := o.add(newWorkerRequest(deletePostQueue, "b")); err != nil {
+		t.Fatal(err)
+	}
+	o.close()
+
+	o, err = openOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.close()
+
+	uids := pendingUIDList(o)
+	if len(uids) != 2 || uids[0] != "a" || uids[1] != "b" {
+		t.Fatalf("pending jobs are %v, want [a b]", uids)
+	}
+}
+
+func TestOutboxFailedWriteLeavesNoRecord(t *testing.T) {
+	path, cleanup := tempOutbox(t)
+	defer cleanup()
+
+	o, err := openOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.add(newWorkerRequest(deletePostQueue, "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	o.file.Close()
+	if err := o.add(newWorkerRequest(deletePostQueue, "lost")); err == nil {
+		t.Fatal("write to closed log succeeded")
+	}
+	if uids := pendingUIDList(o); len(uids) != 1 || uids[0] != "a" {
+		t.Fatalf("pending jobs after failed write are %v, want [a]", uids)
+	}
+
+	// The log is usable again and holds nothing the failed write produced
+	if err := o.add(newWorkerRequest(deletePostQueue, "b")); err != nil {
+		t.Fatal(err)
+	}
+	o.close()
+
+	o, err = openOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.close()
+
+	uids := pendingUIDList(o)
+	if len(uids) != 2 || uids[0] != "a" || uids[1] != "b" {
+		t.Fatalf("pending jobs after reopening are %v, want [a b]", uids)
+	}
+}
+
+func TestOutboxHoldsLastStepsOfCascade(t *testing.T) {
+	path, cleanup := tempOutbox(t)
+	defer cleanup()
+
+	o, err := openOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	posts := newWorkerRequest(deleteCategoryPostsQueue, "cat")
+	posts.cascadeID = "cascade"
+	parent := newWorkerRequest(deleteCategoryQueue, "cat")
+	parent.cascadeID = "cascade"
+	c := cascade{ID: "cascade", Kind: "category", UID: "cat", CreatedAt: time.Now()}
+	if err := o.addCascade(c, []workerRequest{posts}, []workerRequest{parent}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A job enqueued by the enumeration keeps the parent waiting after the
+	// enumeration itself is done
+	child := newWorkerRequest(deletePostQueue, "post")
+	child.cascadeID = "cascade"
+	if err := o.add(child); err != nil {
+		t.Fatal(err)
+	}
+	if released, err := o.done(posts.id, jobStateSucceeded); err != nil || len(released) != 0 {
+		t.Fatalf("released %v (%v) while a child is pending", released, err)
+	}
+	if uids := pendingUIDList(o); len(uids) != 1 || uids[0] != "post" {
+		t.Fatalf("pending jobs are %v, want [post]", uids)
+	}
+
+	// The held job survives restarts
+	o.close()
+	if o, err = openOutbox(path); err != nil {
+		t.Fatal(err)
+	}
+	defer o.close()
+	if job, ok := o.job(parent.id); !ok || job.queue != deleteCategoryQueue {
+		t.Fatalf("held job is %+v, %v", job, ok)
+	}
+
+	released, err := o.done(child.id, jobStateSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(released) != 1 || released[0].id != parent.id {
+		t.Fatalf("released %v, want the parent", released)
+	}
+	if uids := pendingUIDList(o); len(uids) != 1 || uids[0] != "cat" {
+		t.Fatalf("pending jobs are %v, want [cat]", uids)
+	}
+}
+
+func TestOutboxDiscardsHeldStepsOfFailedCascade(t *testing.T) {
+	path, cleanup := tempOutbox(t)
+	defer cleanup()
+
+	o, err := openOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.close()
+
+	posts := newWorkerRequest(deleteUserPostsQueue, "user")
+	posts.cascadeID = "cascade"
+	parent := newWorkerRequest(deleteUserQueue, "user")
+	parent.cascadeID = "cascade"
+	c := cascade{ID: "cascade", Kind: "user", UID: "user", CreatedAt: time.Now()}
+	if err := o.addCascade(c, []workerRequest{posts}, []workerRequest{parent}); err != nil {
+		t.Fatal(err)
+	}
+
+	released, err := o.done(posts.id, jobStateDiscarded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(released) != 0 || len(pendingUIDList(o)) != 0 {
+		t.Fatalf("parent was released after a discarded step")
+	}
+	if got := o.cascades["cascade"].status(); got != cascadeFailed {
+		t.Fatalf("cascade is %s, want %s", got, cascadeFailed)
+	}
+}
+
+func TestOutboxKeepsDeletedPostsUntilForgotten(t *testing.T) {
+	path, cleanup := tempOutbox(t)
+	defer cleanup()
+
+	o, err := openOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A rollback of post creation, it belongs to no cascade
+	rollback := newWorkerRequest(deletePostQueue, "post")
+	stats := newWorkerRequest(deletePostStatsQueue, "post")
+	if err := o.add(rollback, stats); err != nil {
+		t.Fatal(err)
+	}
+	for _, req := range []workerRequest{rollback, stats} {
+		if _, err := o.done(req.id, jobStateSucceeded); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o.close()
+
+	// Compaction on open drops the finished jobs but not the tombstone
+	if o, err = openOutbox(path); err != nil {
+		t.Fatal(err)
+	}
+	if uids := o.deletedUIDs(deletePostQueue); len(uids) != 1 || uids[0] != "post" {
+		t.Fatalf("deleted posts are %v, want [post]", uids)
+	}
+	if uids := o.deletedUIDs(deletePostStatsQueue); len(uids) != 0 {
+		t.Fatalf("stats deletions are remembered: %v", uids)
+	}
+
+	if err := o.forgetDeleted(deletePostQueue, "post"); err != nil {
+		t.Fatal(err)
+	}
+	o.close()
+
+	if o, err = openOutbox(path); err != nil {
+		t.Fatal(err)
+	}
+	defer o.close()
+	if uids := o.deletedUIDs(deletePostQueue); len(uids) != 0 {
+		t.Fatalf("deleted posts after forgetting are %v, want none", uids)
+	}
+}
+
+func TestOutboxExpiresOldTombstones(t *testing.T) {
+	path, cleanup := tempOutbox(t)
+	defer cleanup()
+
+	var lines []byte
+	for uid, at := range map[string]time.Time{
+		"old": time.Now().Add(-tombstoneRetention - time.Hour),
+		"new": time.Now(),
+	} {
+		b, err := json.Marshal(outboxEntry{Op: outboxOpDeleted, At: at, Queue: deletePostQueue, UID: uid})
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(append(lines, b...), '\n')
+	}
+	if err := ioutil.WriteFile(path, lines, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := openOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.close()
+
+	if uids := o.deletedUIDs(deletePostQueue); len(uids) != 1 || uids[0] != "new" {
+		t.Fatalf("deleted posts are %v, want [new]", uids)
+	}
+	if _, ok := o.deleted[deletePostQueue+"/old"]; ok {
+		t.Fatal("expired tombstone survived compaction")
+	}
+}
@@ -0,0 +1,312 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	category "github.com/andreymgn/RSOI-category/pkg/category/proto"
+	comment "github.com/andreymgn/RSOI-comment/pkg/comment/proto"
+	post "github.com/andreymgn/RSOI-post/pkg/post/proto"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// rule grants access to the caller, e.g. when they own the resource named by
+// the request. Lookup errors are returned to the client as is.
+type rule struct {
+	name  string
+	allow func(s *Server, r *http.Request, p *Principal) (bool, error)
+}
+
+// policy grants access if any of its rules does, rules are checked in order
+type policy []rule
+
+func anyOf(rules ...rule) policy {
+	return policy(rules)
+}
+
+func (p policy) String() string {
+	names := make([]string, len(p))
+	for i, r := range p {
+		names[i] = r.name
+	}
+
+	return strings.Join(names, " OR ")
+}
+
+// globalAdmin grants access to administrators
+var globalAdmin = rule{"global-admin", func(s *Server, r *http.Request, p *Principal) (bool, error) {
+	return p.Admin, nil
+}}
+
+// self grants access to the user named by path variable v
+func self(v string) rule {
+	return rule{"self", func(s *Server, r *http.Request, p *Principal) (bool, error) {
+		return p.UID == mux.Vars(r)[v], nil
+	}}
+}
+
+// postOwner grants access to author of the post named by path variable v
+func postOwner(v string) rule {
+	return rule{"post-owner", func(s *Server, r *http.Request, p *Principal) (bool, error) {
+		owner, err := s.postOwner(r.Context(), mux.Vars(r)[v])
+		return owner == p.UID, err
+	}}
+}
+
+// commentOwner grants access to author of the comment named by path variable v
+func commentOwner(v string) rule {
+	return rule{"comment-owner", func(s *Server, r *http.Request, p *Principal) (bool, error) {
+		owner, err := s.commentOwner(r.Context(), mux.Vars(r)[v])
+		return owner == p.UID, err
+	}}
+}
+
+// categoryModerator grants access to creator of the category named by path
+// variable v
+func categoryModerator(v string) rule {
+	return rule{"category-moderator", func(s *Server, r *http.Request, p *Principal) (bool, error) {
+		moderator, err := s.categoryModerator(r.Context(), mux.Vars(r)[v])
+		return moderator == p.UID, err
+	}}
+}
+
+// postModerator grants access to creator of the category which the post named
+// by path variable v belongs to
+func postModerator(v string) rule {
+	return rule{"category-moderator", func(s *Server, r *http.Request, p *Principal) (bool, error) {
+		categoryUID, err := s.postCategory(r.Context(), mux.Vars(r)[v])
+		if err != nil {
+			return false, err
+		}
+
+		moderator, err := s.categoryModerator(r.Context(), categoryUID)
+		return moderator == p.UID, err
+	}}
+}
+
+// commentModerator grants access to creator of the category which post of the
+// comment named by path variable v belongs to
+func commentModerator(v string) rule {
+	return rule{"category-moderator", func(s *Server, r *http.Request, p *Principal) (bool, error) {
+		postUID, err := s.commentPost(r.Context(), mux.Vars(r)[v])
+		if err != nil {
+			return false, err
+		}
+
+		categoryUID, err := s.postCategory(r.Context(), postUID)
+		if err != nil {
+			return false, err
+		}
+
+		moderator, err := s.categoryModerator(r.Context(), categoryUID)
+		return moderator == p.UID, err
+	}}
+}
+
+// reportModerator grants access to creator of the category named by path
+// variable category if the report named by path variable v was filed in it
+func reportModerator(category, v string) rule {
+	return rule{"category-moderator", func(s *Server, r *http.Request, p *Principal) (bool, error) {
+		vars := mux.Vars(r)
+		moderator, err := s.categoryModerator(r.Context(), vars[category])
+		if err != nil || moderator != p.UID {
+			return false, err
+		}
+
+		// Reports can only be looked up by category, so the report is
+		// searched for only once the caller is known to moderate it
+		uids, err := listReportUIDs(r.Context(), s.categoryClient.client, vars[category])
+		if err != nil {
+			return false, err
+		}
+		for _, uid := range uids {
+			if uid == vars[v] {
+				return true, nil
+			}
+		}
+
+		return false, status.Error(codes.NotFound, "report not found")
+	}}
+}
+
+// jobOwner grants access to the user who started the cascade named by path
+// variable v
+func jobOwner(v string) rule {
+	return rule{"job-owner", func(s *Server, r *http.Request, p *Principal) (bool, error) {
+		c, ok := s.outbox.cascade(mux.Vars(r)[v])
+		if !ok {
+			return false, status.Error(codes.NotFound, "job not found")
+		}
+
+		return c.UserUID == p.UID, nil
+	}}
+}
+
+// authorize lets the caller through if pol grants them access. Anonymous
+// requests get 401 and denied ones 403, every decision is logged for audit.
+func (s *Server) authorize(pol policy, next http.HandlerFunc) http.HandlerFunc {
+	return s.requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		p := principalFrom(r.Context())
+		entry := logger(r.Context()).WithField("policy", pol.String()).WithField("resource", r.Method+" "+r.URL.Path)
+
+		for _, rl := range pol {
+			ok, err := rl.allow(s, r, p)
+			if err != nil {
+				entry.WithError(err).WithField("rule", rl.name).Warn("authorization failed")
+				handleRPCError(w, r, err)
+				return
+			}
+
+			if ok {
+				entry.WithField("allowed", true).WithField("rule", rl.name).Info("authorization decision")
+				next(w, r)
+				return
+			}
+		}
+
+		entry.WithField("allowed", false).Info("authorization decision")
+		writeError(w, r, http.StatusForbidden, "you are not allowed to do this")
+	})
+}
+
+type lookupEntry struct {
+	value   string
+	expires time.Time
+}
+
+// lookupCache keeps owners of resources for authorization. Owners don't change,
+// so entries only go away when the resource is deleted or they expire.
+type lookupCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]lookupEntry
+}
+
+func newLookupCache(c AuthConfig) *lookupCache {
+	return &lookupCache{size: c.CacheSize, ttl: c.PolicyCacheTTL, entries: make(map[string]lookupEntry)}
+}
+
+func (c *lookupCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return "", false
+	}
+
+	return e.value, true
+}
+
+func (c *lookupCache) add(key, value string) {
+	if c.size <= 0 || c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= c.size {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	if len(c.entries) >= c.size {
+		// Nothing expired, drop an arbitrary entry
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+
+	c.entries[key] = lookupEntry{value, now.Add(c.ttl)}
+}
+
+func (c *lookupCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, key)
+}
+
+// lookup returns cached value of key or fetches it
+func (c *lookupCache) lookup(key string, fetch func() (string, error)) (string, error) {
+	if v, ok := c.get(key); ok {
+		return v, nil
+	}
+
+	v, err := fetch()
+	if err != nil {
+		return "", err
+	}
+
+	c.add(key, v)
+	return v, nil
+}
+
+func (s *Server) postOwner(ctx context.Context, uid string) (string, error) {
+	return s.lookups.lookup("post/"+uid, func() (string, error) {
+		resp, err := s.postClient.client.GetPostOwner(ctx, &post.GetPostOwnerRequest{Uid: uid})
+		if err != nil {
+			return "", err
+		}
+
+		return resp.OwnerUid, nil
+	})
+}
+
+func (s *Server) commentOwner(ctx context.Context, uid string) (string, error) {
+	return s.lookups.lookup("comment/"+uid, func() (string, error) {
+		resp, err := s.commentClient.client.GetOwner(ctx, &comment.GetOwnerRequest{Uid: uid})
+		if err != nil {
+			return "", err
+		}
+
+		return resp.OwnerUid, nil
+	})
+}
+
+func (s *Server) categoryModerator(ctx context.Context, uid string) (string, error) {
+	return s.lookups.lookup("category/"+uid, func() (string, error) {
+		resp, err := s.categoryClient.client.GetCategoryInfo(ctx, &category.GetCategoryInfoRequest{Uid: uid})
+		if err != nil {
+			return "", err
+		}
+
+		return resp.UserUid, nil
+	})
+}
+
+// postCategory returns UID of the category post uid belongs to
+func (s *Server) postCategory(ctx context.Context, uid string) (string, error) {
+	return s.lookups.lookup("post-category/"+uid, func() (string, error) {
+		resp, err := s.postClient.client.GetPost(ctx, &post.GetPostRequest{Uid: uid})
+		if err != nil {
+			return "", err
+		}
+
+		return resp.CategoryUid, nil
+	})
+}
+
+// commentPost returns UID of the post comment uid belongs to
+func (s *Server) commentPost(ctx context.Context, uid string) (string, error) {
+	return s.lookups.lookup("comment-post/"+uid, func() (string, error) {
+		resp, err := s.commentClient.client.GetComment(ctx, &comment.GetCommentRequest{Uid: uid})
+		if err != nil {
+			return "", err
+		}
+
+		return resp.PostUid, nil
+	})
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
@@ -8,10 +9,8 @@ import (
 	"time"
 
 	category "github.com/andreymgn/RSOI-category/pkg/category/proto"
-	comment "github.com/andreymgn/RSOI-comment/pkg/comment/proto"
 	post "github.com/andreymgn/RSOI-post/pkg/post/proto"
 	poststats "github.com/andreymgn/RSOI-poststats/pkg/poststats/proto"
-	user "github.com/andreymgn/RSOI-user/pkg/user/proto"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
@@ -45,7 +44,7 @@ func (s *Server) getPosts() http.HandlerFunc {
 		if page != "" {
 			n, err := strconv.Atoi(page)
 			if err != nil {
-				http.Error(w, "can't parse query parameter `page`", http.StatusBadRequest)
+				writeError(w, r, http.StatusBadRequest, "can't parse query parameter `page`")
 				return
 			}
 			pageNum = int32(n)
@@ -54,7 +53,7 @@ func (s *Server) getPosts() http.HandlerFunc {
 		if size != "" {
 			n, err := strconv.Atoi(size)
 			if err != nil {
-				http.Error(w, "can't parse query parameter `size`", http.StatusBadRequest)
+				writeError(w, r, http.StatusBadRequest, "can't parse query parameter `size`")
 				return
 			}
 			sizeNum = int32(n)
@@ -65,11 +64,12 @@ func (s *Server) getPosts() http.HandlerFunc {
 			&post.ListPostsRequest{PageSize: sizeNum, PageNumber: pageNum},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		posts := make([]p, len(postResponse.Posts))
+		hidden := make([]bool, len(postResponse.Posts))
 		for i, singlePostResponse := range postResponse.Posts {
 			posts[i].UID = singlePostResponse.Uid
 			posts[i].UserUID = singlePostResponse.UserUid
@@ -78,26 +78,29 @@ func (s *Server) getPosts() http.HandlerFunc {
 			posts[i].URL = singlePostResponse.Url
 			posts[i].CreatedAt, err = ptypes.Timestamp(singlePostResponse.CreatedAt)
 			if err != nil {
-				handleRPCError(w, err)
+				handleRPCError(w, r, err)
 				return
 			}
 
 			posts[i].ModifiedAt, err = ptypes.Timestamp(singlePostResponse.ModifiedAt)
 			if err != nil {
-				handleRPCError(w, err)
+				handleRPCError(w, r, err)
 				return
 			}
 
 			postStats, err := s.postStatsClient.client.GetPostStats(ctx,
 				&poststats.GetPostStatsRequest{PostUid: posts[i].UID},
 			)
-			if st, ok := status.FromError(err); ok && st.Code() == codes.Unavailable {
+			if status.Code(err) == codes.NotFound {
+				// Post without stats is being created or rolled back
+				hidden[i] = true
+			} else if st, ok := status.FromError(err); ok && st.Code() == codes.Unavailable {
 				posts[i].NumLikes = -1
 				posts[i].NumDislikes = -1
 				posts[i].NumViews = -1
 
 			} else if err != nil {
-				handleRPCError(w, err)
+				handleRPCError(w, r, err)
 				return
 			} else {
 				posts[i].NumLikes = postStats.NumLikes
@@ -106,10 +109,17 @@ func (s *Server) getPosts() http.HandlerFunc {
 			}
 		}
 
-		resp := response{posts, sizeNum, pageNum}
+		visible := make([]p, 0, len(posts))
+		for i := range posts {
+			if !hidden[i] {
+				visible = append(visible, posts[i])
+			}
+		}
+
+		resp := response{visible, sizeNum, pageNum}
 		json, err := json.Marshal(resp)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -147,7 +157,7 @@ func (s *Server) getPostsByCategory() http.HandlerFunc {
 		if page != "" {
 			n, err := strconv.Atoi(page)
 			if err != nil {
-				http.Error(w, "can't parse query parameter `page`", http.StatusBadRequest)
+				writeError(w, r, http.StatusBadRequest, "can't parse query parameter `page`")
 				return
 			}
 			pageNum = int32(n)
@@ -156,7 +166,7 @@ func (s *Server) getPostsByCategory() http.HandlerFunc {
 		if size != "" {
 			n, err := strconv.Atoi(size)
 			if err != nil {
-				http.Error(w, "can't parse query parameter `size`", http.StatusBadRequest)
+				writeError(w, r, http.StatusBadRequest, "can't parse query parameter `size`")
 				return
 			}
 			sizeNum = int32(n)
@@ -167,11 +177,12 @@ func (s *Server) getPostsByCategory() http.HandlerFunc {
 			&post.ListPostsByCategoryRequest{PageSize: sizeNum, PageNumber: pageNum, CategoryUid: uid},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		posts := make([]p, len(postResponse.Posts))
+		hidden := make([]bool, len(postResponse.Posts))
 		for i, singlePostResponse := range postResponse.Posts {
 			posts[i].UID = singlePostResponse.Uid
 			posts[i].UserUID = singlePostResponse.UserUid
@@ -180,26 +191,29 @@ func (s *Server) getPostsByCategory() http.HandlerFunc {
 			posts[i].URL = singlePostResponse.Url
 			posts[i].CreatedAt, err = ptypes.Timestamp(singlePostResponse.CreatedAt)
 			if err != nil {
-				handleRPCError(w, err)
+				handleRPCError(w, r, err)
 				return
 			}
 
 			posts[i].ModifiedAt, err = ptypes.Timestamp(singlePostResponse.ModifiedAt)
 			if err != nil {
-				handleRPCError(w, err)
+				handleRPCError(w, r, err)
 				return
 			}
 
 			postStats, err := s.postStatsClient.client.GetPostStats(ctx,
 				&poststats.GetPostStatsRequest{PostUid: posts[i].UID},
 			)
-			if st, ok := status.FromError(err); ok && st.Code() == codes.Unavailable {
+			if status.Code(err) == codes.NotFound {
+				// Post without stats is being created or rolled back
+				hidden[i] = true
+			} else if st, ok := status.FromError(err); ok && st.Code() == codes.Unavailable {
 				posts[i].NumLikes = -1
 				posts[i].NumDislikes = -1
 				posts[i].NumViews = -1
 
 			} else if err != nil {
-				handleRPCError(w, err)
+				handleRPCError(w, r, err)
 				return
 			} else {
 				posts[i].NumLikes = postStats.NumLikes
@@ -208,10 +222,17 @@ func (s *Server) getPostsByCategory() http.HandlerFunc {
 			}
 		}
 
-		resp := response{posts, sizeNum, pageNum}
+		visible := make([]p, 0, len(posts))
+		for i := range posts {
+			if !hidden[i] {
+				visible = append(visible, posts[i])
+			}
+		}
+
+		resp := response{visible, sizeNum, pageNum}
 		json, err := json.Marshal(resp)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -242,33 +263,24 @@ func (s *Server) createPost() http.HandlerFunc {
 		vars := mux.Vars(r)
 		uid := vars["uid"]
 
-		userToken := getAuthorizationToken(r)
-		if userToken == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
-		userUID, err := s.getUIDByToken(userToken)
-		if err != nil {
-			handleRPCError(w, err)
-			return
-		}
-
-		if userUID == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
+		userUID := principalFrom(r.Context()).UID
 
 		var req request
 		b, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		err = json.Unmarshal(b, &req)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			writeError(w, r, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+
+		// Deleting the category also removes posts that slip past this check
+		if s.outbox.pendingUIDs(deleteCategoryQueue)[uid] {
+			writeError(w, r, http.StatusConflict, "category is being deleted")
 			return
 		}
 
@@ -277,7 +289,7 @@ func (s *Server) createPost() http.HandlerFunc {
 			&post.CreatePostRequest{Title: req.Title, Url: req.URL, UserUid: userUID, CategoryUid: uid},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -285,43 +297,37 @@ func (s *Server) createPost() http.HandlerFunc {
 			&poststats.CreatePostStatsRequest{PostUid: p.Uid},
 		)
 		if err != nil {
-			if st, ok := status.FromError(err); ok {
-				if st.Code() == codes.Unavailable {
-					_, err := s.postClient.client.DeletePost(ctx,
-						&post.DeletePostRequest{Uid: p.Uid},
-					)
-					if err != nil {
-						handleRPCError(w, err)
-						return
-					}
-					w.WriteHeader(http.StatusServiceUnavailable)
-				} else {
-					handleRPCError(w, err)
-					return
-				}
-
-			} else {
-				handleRPCError(w, err)
-				return
+			// Roll back in the background. Until the post is gone it is hidden
+			// from readers because it has no stats. Stats are deleted too in
+			// case they were created despite the error.
+			compensateErr := s.enqueue(ctx,
+				newWorkerRequest(deletePostQueue, p.Uid),
+				newWorkerRequest(deletePostStatsQueue, p.Uid),
+			)
+			if compensateErr != nil {
+				logger(ctx).WithError(compensateErr).WithField("post_uid", p.Uid).Error("can't schedule rollback of post")
 			}
+
+			handleRPCError(w, r, err)
+			return
 		}
 
 		createdAt, err := ptypes.Timestamp(p.CreatedAt)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		modifiedAt, err := ptypes.Timestamp(p.ModifiedAt)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		response := response{p.Uid, p.UserUid, p.Title, p.Url, createdAt, modifiedAt, 0, 0, 0}
 		json, err := json.Marshal(response)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -353,7 +359,7 @@ func (s *Server) getPost() http.HandlerFunc {
 			&post.GetPostRequest{Uid: uid},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -365,21 +371,23 @@ func (s *Server) getPost() http.HandlerFunc {
 		res.URL = postResponse.Url
 		res.CreatedAt, err = ptypes.Timestamp(postResponse.CreatedAt)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		res.ModifiedAt, err = ptypes.Timestamp(postResponse.ModifiedAt)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
+		// Post without stats is being created or rolled back, so it is reported
+		// as missing
 		postStats, err := s.postStatsClient.client.GetPostStats(ctx,
 			&poststats.GetPostStatsRequest{PostUid: res.UID},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -389,7 +397,7 @@ func (s *Server) getPost() http.HandlerFunc {
 
 		json, err := json.Marshal(res)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -397,7 +405,7 @@ func (s *Server) getPost() http.HandlerFunc {
 			&poststats.IncreaseViewsRequest{PostUid: uid},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -413,33 +421,16 @@ func (s *Server) updatePost() http.HandlerFunc {
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		userToken := getAuthorizationToken(r)
-		if userToken == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
-		userUID, err := s.getUIDByToken(userToken)
-		if err != nil {
-			handleRPCError(w, err)
-			return
-		}
-
-		if userUID == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
 		var req request
 		b, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		err = json.Unmarshal(b, &req)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			writeError(w, r, http.StatusUnprocessableEntity, err.Error())
 			return
 		}
 
@@ -447,24 +438,11 @@ func (s *Server) updatePost() http.HandlerFunc {
 		uid := vars["uid"]
 
 		ctx := r.Context()
-		owner, err := s.postClient.client.GetPostOwner(ctx,
-			&post.GetPostOwnerRequest{Uid: uid},
-		)
-		if err != nil {
-			handleRPCError(w, err)
-			return
-		}
-
-		if userUID != owner.OwnerUid {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-
 		_, err = s.postClient.client.UpdatePost(ctx,
 			&post.UpdatePostRequest{Uid: uid, Title: req.Title, Url: req.URL},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -474,80 +452,25 @@ func (s *Server) updatePost() http.HandlerFunc {
 
 func (s *Server) deletePost() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userToken := getAuthorizationToken(r)
-		if userToken == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
-		userUID, err := s.getUIDByToken(userToken)
-		if err != nil {
-			handleRPCError(w, err)
-			return
-		}
-
-		if userUID == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
+		userUID := principalFrom(r.Context()).UID
 
 		vars := mux.Vars(r)
 		uid := vars["uid"]
-		categoryUID := vars["categoryuid"]
-
-		ctx := r.Context()
-		owner, err := s.postClient.client.GetPostOwner(ctx,
-			&post.GetPostOwnerRequest{Uid: uid},
-		)
-		if err != nil {
-			handleRPCError(w, err)
-			return
-		}
-
-		if userUID != owner.OwnerUid {
-			// Check if current user is global admin
-			userInfo, err := s.userClient.client.GetUserInfo(ctx,
-				&user.GetUserInfoRequest{Uid: userUID},
-			)
-			if err != nil {
-				handleRPCError(w, err)
-				return
-			}
 
-			if !userInfo.IsAdmin {
-				// Check if current user is category admin
-				categoryInfo, err := s.categoryClient.client.GetCategoryInfo(ctx,
-					&category.GetCategoryInfoRequest{Uid: categoryUID},
-				)
-				if err != nil {
-					handleRPCError(w, err)
-					return
-				}
-
-				if userUID != categoryInfo.UserUid {
-					w.WriteHeader(http.StatusUnauthorized)
-					return
-				}
-			}
-		}
-
-		s.deletePostChannel <- workerRequest{uid, time.Now()}
-
-		s.deletePostStatsChannel <- workerRequest{uid, time.Now()}
-
-		comments, err := s.commentClient.client.ListComments(ctx,
-			&comment.ListCommentsRequest{PostUid: uid},
-		)
+		c := newCascade(cascadeDeletePost, uid, userUID)
+		err := s.startCascade(r.Context(), c, []workerRequest{
+			newWorkerRequest(deletePostQueue, uid),
+			newWorkerRequest(deletePostStatsQueue, uid),
+			newWorkerRequest(deletePostCommentsQueue, uid),
+		})
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
+		s.lookups.remove("post/" + uid)
+		s.lookups.remove("post-category/" + uid)
 
-		for _, c := range comments.Comments {
-			s.deleteCommentChannel <- workerRequest{c.Uid, time.Now()}
-		}
-
-		w.WriteHeader(http.StatusNoContent)
+		acceptCascade(w, r, c)
 	}
 }
 
@@ -558,22 +481,7 @@ func (s *Server) likePost() http.HandlerFunc {
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		userToken := getAuthorizationToken(r)
-		if userToken == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
-		userUID, err := s.getUIDByToken(userToken)
-		if err != nil {
-			handleRPCError(w, err)
-			return
-		}
-
-		if userUID == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
+		userUID := principalFrom(r.Context()).UID
 
 		vars := mux.Vars(r)
 		uid := vars["uid"]
@@ -583,7 +491,7 @@ func (s *Server) likePost() http.HandlerFunc {
 			&poststats.LikePostRequest{PostUid: uid, UserUid: userUID},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -591,7 +499,7 @@ func (s *Server) likePost() http.HandlerFunc {
 
 		json, err := json.Marshal(res)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -607,22 +515,7 @@ func (s *Server) dislikePost() http.HandlerFunc {
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		userToken := getAuthorizationToken(r)
-		if userToken == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
-		userUID, err := s.getUIDByToken(userToken)
-		if err != nil {
-			handleRPCError(w, err)
-			return
-		}
-
-		if userUID == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
+		userUID := principalFrom(r.Context()).UID
 
 		vars := mux.Vars(r)
 		uid := vars["uid"]
@@ -632,7 +525,7 @@ func (s *Server) dislikePost() http.HandlerFunc {
 			&poststats.DislikePostRequest{PostUid: uid, UserUid: userUID},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -640,7 +533,7 @@ func (s *Server) dislikePost() http.HandlerFunc {
 
 		json, err := json.Marshal(res)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -664,33 +557,16 @@ func (s *Server) reportPost() http.HandlerFunc {
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		userToken := getAuthorizationToken(r)
-		if userToken == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
-		userUID, err := s.getUIDByToken(userToken)
-		if err != nil {
-			handleRPCError(w, err)
-			return
-		}
-
-		if userUID == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
 		var req request
 		b, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		err = json.Unmarshal(b, &req)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			writeError(w, r, http.StatusUnprocessableEntity, err.Error())
 			return
 		}
 
@@ -703,20 +579,20 @@ func (s *Server) reportPost() http.HandlerFunc {
 			&category.CreateReportRequest{CategoryUid: categoryUID, PostUid: postUID, Reason: req.Reason, CommentUid: uuid.Nil.String()},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		createdAt, err := ptypes.Timestamp(report.CreatedAt)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		response := response{report.Uid, report.CategoryUid, report.PostUid, report.CommentUid, report.Reason, createdAt}
 		json, err := json.Marshal(response)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -724,3 +600,39 @@ func (s *Server) reportPost() http.HandlerFunc {
 		w.Write(json)
 	}
 }
+
+// listCategoryPostUIDs returns UIDs of all posts of category categoryUID
+func listCategoryPostUIDs(ctx context.Context, pc post.PostClient, categoryUID string) ([]string, error) {
+	return listPages(func(page int32) ([]string, error) {
+		postResponse, err := pc.ListPostsByCategory(ctx,
+			&post.ListPostsByCategoryRequest{PageSize: cascadePageSize, PageNumber: page, CategoryUid: categoryUID},
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		uids := make([]string, len(postResponse.Posts))
+		for i, p := range postResponse.Posts {
+			uids[i] = p.Uid
+		}
+		return uids, nil
+	})
+}
+
+// listUserPostUIDs returns UIDs of all posts of user userUID
+func listUserPostUIDs(ctx context.Context, pc post.PostClient, userUID string) ([]string, error) {
+	return listPages(func(page int32) ([]string, error) {
+		postResponse, err := pc.ListPostsByUser(ctx,
+			&post.ListPostsByUserRequest{PageSize: cascadePageSize, PageNumber: page, UserUid: userUID},
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		uids := make([]string, len(postResponse.Posts))
+		for i, p := range postResponse.Posts {
+			uids[i] = p.Uid
+		}
+		return uids, nil
+	})
+}
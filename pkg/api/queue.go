@@ -0,0 +1,151 @@
+package api
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// jobHeap orders jobs by the time they become due
+type jobHeap []workerRequest
+
+func (h jobHeap) Len() int            { return len(h) }
+func (h jobHeap) Less(i, j int) bool  { return h[i].doneTime.Before(h[j].doneTime) }
+func (h jobHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *jobHeap) Push(x interface{}) { *h = append(*h, x.(workerRequest)) }
+
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// jobQueue is an unbounded queue which hands out jobs only once they are due.
+// Jobs handed out are tracked as in flight until released.
+type jobQueue struct {
+	mu       sync.Mutex
+	jobs     jobHeap
+	inFlight map[string]workerRequest
+	wakeup   chan struct{}
+}
+
+func newJobQueue() *jobQueue {
+	return &jobQueue{inFlight: make(map[string]workerRequest), wakeup: make(chan struct{}, 1)}
+}
+
+func (q *jobQueue) signal() {
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// push adds job to the queue, it never blocks
+func (q *jobQueue) push(req workerRequest) {
+	q.mu.Lock()
+	heap.Push(&q.jobs, req)
+	q.mu.Unlock()
+
+	q.signal()
+}
+
+// pop blocks until a job is due and returns it, the job stays in flight until
+// release is called. It returns false once ctx is done.
+func (q *jobQueue) pop(ctx context.Context) (workerRequest, bool) {
+	for {
+		if ctx.Err() != nil {
+			return workerRequest{}, false
+		}
+
+		q.mu.Lock()
+		wait := time.Duration(-1)
+		if len(q.jobs) > 0 {
+			wait = time.Until(q.jobs[0].doneTime)
+			if wait <= 0 {
+				req := heap.Pop(&q.jobs).(workerRequest)
+				q.inFlight[req.id] = req
+				if len(q.jobs) > 0 {
+					q.signal()
+				}
+				q.mu.Unlock()
+				return req, true
+			}
+		}
+		q.mu.Unlock()
+
+		if wait < 0 {
+			select {
+			case <-q.wakeup:
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-q.wakeup:
+		case <-t.C:
+		case <-ctx.Done():
+		}
+		t.Stop()
+	}
+}
+
+// release marks job returned by pop as no longer in flight
+func (q *jobQueue) release(id string) {
+	q.mu.Lock()
+	delete(q.inFlight, id)
+	q.mu.Unlock()
+}
+
+// requeue atomically moves job from in flight back to the queue
+func (q *jobQueue) requeue(req workerRequest) {
+	q.mu.Lock()
+	delete(q.inFlight, req.id)
+	heap.Push(&q.jobs, req)
+	q.mu.Unlock()
+
+	q.signal()
+}
+
+// list returns copies of queued and in flight jobs
+func (q *jobQueue) list() (queued, inFlight []workerRequest) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queued = make([]workerRequest, len(q.jobs))
+	copy(queued, q.jobs)
+	inFlight = make([]workerRequest, 0, len(q.inFlight))
+	for _, req := range q.inFlight {
+		inFlight = append(inFlight, req)
+	}
+
+	return queued, inFlight
+}
+
+// remove takes a queued job out of the queue
+func (q *jobQueue) remove(id string) (workerRequest, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, req := range q.jobs {
+		if req.id == id {
+			heap.Remove(&q.jobs, i)
+			return req, true
+		}
+	}
+
+	return workerRequest{}, false
+}
+
+// isInFlight reports whether job is being processed right now
+func (q *jobQueue) isInFlight(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	_, ok := q.inFlight[id]
+	return ok
+}
@@ -0,0 +1,403 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// Rate limit keys say what requests are counted by
+const (
+	RateLimitByIP   = "ip"
+	RateLimitByUser = "user"
+	RateLimitByApp  = "app"
+)
+
+// RateLimitPolicy is a token bucket which holds Burst tokens and gains Limit
+// tokens every Period, each request takes one token
+type RateLimitPolicy struct {
+	// Key is what requests are counted by: ip, user or app. Requests
+	// without a token, or with a token not issued to an application when
+	// counted by app, are counted by IP. Only signed tokens name the
+	// application, requests with opaque tokens are always counted by IP
+	// under app policies.
+	Key    string
+	Limit  int
+	Period time.Duration
+	// Burst is the size of the bucket, Limit is used when it is zero
+	Burst int
+}
+
+// ParseRateLimitPolicy parses policy written as key:limit/period[:burst],
+// e.g. "ip:10/1m" or "user:5/1s:20"
+func ParseRateLimitPolicy(s string) (RateLimitPolicy, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return RateLimitPolicy{}, fmt.Errorf("rate limit %q is not key:limit/period[:burst]", s)
+	}
+
+	p := RateLimitPolicy{Key: parts[0]}
+	switch p.Key {
+	case RateLimitByIP, RateLimitByUser, RateLimitByApp:
+	default:
+		return RateLimitPolicy{}, fmt.Errorf("unknown rate limit key %q, expected ip, user or app", p.Key)
+	}
+
+	rate := strings.SplitN(parts[1], "/", 2)
+	if len(rate) != 2 {
+		return RateLimitPolicy{}, fmt.Errorf("rate %q is not limit/period", parts[1])
+	}
+
+	var err error
+	if p.Limit, err = strconv.Atoi(rate[0]); err != nil || p.Limit <= 0 {
+		return RateLimitPolicy{}, fmt.Errorf("limit %q is not a positive number", rate[0])
+	}
+	if p.Period, err = time.ParseDuration(rate[1]); err != nil || p.Period <= 0 {
+		return RateLimitPolicy{}, fmt.Errorf("period %q is not a positive duration", rate[1])
+	}
+	if len(parts) == 3 {
+		if p.Burst, err = strconv.Atoi(parts[2]); err != nil || p.Burst <= 0 {
+			return RateLimitPolicy{}, fmt.Errorf("burst %q is not a positive number", parts[2])
+		}
+	}
+
+	return p, nil
+}
+
+func (p RateLimitPolicy) String() string {
+	if p.Limit == 0 {
+		return ""
+	}
+
+	s := p.Key + ":" + strconv.Itoa(p.Limit) + "/" + p.Period.String()
+	if p.Burst > 0 {
+		s += ":" + strconv.Itoa(p.Burst)
+	}
+
+	return s
+}
+
+// Enabled reports whether the policy limits anything
+func (p RateLimitPolicy) Enabled() bool {
+	return p.Limit > 0 && p.Period > 0
+}
+
+func (p RateLimitPolicy) capacity() int {
+	if p.Burst > 0 {
+		return p.Burst
+	}
+
+	return p.Limit
+}
+
+// RateLimitConfig controls rate limiting of the API
+type RateLimitConfig struct {
+	// Default applies to routes without a policy, zero policy disables it
+	Default RateLimitPolicy
+	// Routes sets policy of a route group, keyed like HTTPConfig.RouteTimeouts
+	// or by a template prefix ending with "*", e.g. "/api/oauth/*". Routes of
+	// a group share buckets.
+	Routes map[string]RateLimitPolicy
+	// TrustedProxies lists CIDRs of proxies whose ClientIPHeader is believed.
+	// Behind a load balancer it must include the balancer, otherwise every
+	// client is counted by its address and shares one bucket.
+	TrustedProxies []string
+	// ClientIPHeader carries address of the client set by trusted proxies,
+	// X-Forwarded-For or X-Real-IP
+	ClientIPHeader string
+}
+
+// DefaultRateLimitConfig returns RateLimitConfig which protects endpoints
+// taking credentials from guessing and writes which are cheap to abuse.
+// Behind a proxy TrustedProxies must be set for the IP limits to work.
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		Routes: map[string]RateLimitPolicy{
+			"POST /api/auth/token":   {Key: RateLimitByIP, Limit: 10, Period: time.Minute},
+			"POST /api/auth/refresh": {Key: RateLimitByIP, Limit: 30, Period: time.Minute},
+			"POST /api/oauth/token":  {Key: RateLimitByIP, Limit: 30, Period: time.Minute},
+			"POST /api/categories/{categoryuid}/posts/{postuid}/comments/": {Key: RateLimitByUser, Limit: 10, Period: time.Minute, Burst: 5},
+			"PATCH /api/categories/{categoryuid}/posts/{uid}/like":         {Key: RateLimitByUser, Limit: 60, Period: time.Minute},
+			"PATCH /api/categories/{categoryuid}/posts/{uid}/dislike":      {Key: RateLimitByUser, Limit: 60, Period: time.Minute},
+		},
+		ClientIPHeader: "X-Forwarded-For",
+	}
+}
+
+// RateLimitResult is the state of a bucket after a request took a token from it
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	// RetryAfter is the time until the next token is added when the request
+	// isn't allowed
+	RetryAfter time.Duration
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+}
+
+// RateLimitStore keeps token buckets. The in-memory store limits each gateway
+// separately, a store shared by replicas, e.g. backed by Redis, makes the
+// limits global.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, p RateLimitPolicy) (RateLimitResult, error)
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket is refilled if no requests are made
+	full time.Time
+}
+
+// memoryStore is RateLimitStore local to the process
+type memoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// NewMemoryRateLimitStore returns RateLimitStore which keeps buckets in memory
+func NewMemoryRateLimitStore() RateLimitStore {
+	return &memoryStore{buckets: make(map[string]*bucket), lastSweep: time.Now()}
+}
+
+// memorySweepInterval is how often full buckets are forgotten
+const memorySweepInterval = time.Minute
+
+func (m *memoryStore) Take(ctx context.Context, key string, p RateLimitPolicy) (RateLimitResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	capacity := float64(p.capacity())
+	perToken := p.Period / time.Duration(p.Limit)
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updated: now}
+		m.buckets[key] = b
+	} else {
+		b.tokens = math.Min(capacity, b.tokens+float64(now.Sub(b.updated))/float64(perToken))
+		b.updated = now
+	}
+
+	var result RateLimitResult
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - b.tokens) * float64(perToken))
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = time.Duration((capacity - b.tokens) * float64(perToken))
+	b.full = now.Add(result.Reset)
+
+	if now.Sub(m.lastSweep) >= memorySweepInterval {
+		m.sweep(now)
+	}
+
+	return result, nil
+}
+
+// sweep forgets buckets which have been refilled since their last request,
+// they are the same as new ones. It must be called with m.mu held.
+func (m *memoryStore) sweep(now time.Time) {
+	m.lastSweep = now
+	for key, b := range m.buckets {
+		if !now.Before(b.full) {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// rateLimiter applies RateLimitConfig to requests
+type rateLimiter struct {
+	conf     RateLimitConfig
+	trusted  []*net.IPNet
+	prefixes []string
+	store    RateLimitStore
+}
+
+func newRateLimiter(c RateLimitConfig) (*rateLimiter, error) {
+	l := &rateLimiter{conf: c, store: NewMemoryRateLimitStore()}
+	for _, cidr := range c.TrustedProxies {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q is not a CIDR", cidr)
+		}
+		l.trusted = append(l.trusted, n)
+	}
+
+	policies := map[string]RateLimitPolicy{"default": c.Default}
+	for route, p := range c.Routes {
+		if p.Enabled() && p.Key != RateLimitByIP && p.Key != RateLimitByUser && p.Key != RateLimitByApp {
+			return nil, fmt.Errorf("unknown rate limit key %q of %q", p.Key, route)
+		}
+		policies[route] = p
+
+		if strings.HasSuffix(route, "*") {
+			l.prefixes = append(l.prefixes, route)
+		}
+	}
+	sort.Slice(l.prefixes, func(i, j int) bool { return len(l.prefixes[i]) > len(l.prefixes[j]) })
+
+	if len(l.trusted) == 0 {
+		for route, p := range policies {
+			if p.Enabled() && p.Key != RateLimitByUser {
+				log.WithField("route", route).Warn("rate limit counts requests by IP but no trusted proxies are set, behind a proxy all clients share one bucket")
+			}
+		}
+	}
+
+	return l, nil
+}
+
+// policy returns policy of the request and the name of its group
+func (l *rateLimiter) policy(r *http.Request) (RateLimitPolicy, string) {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return l.conf.Default, ""
+	}
+
+	tpl, err := route.GetPathTemplate()
+	if err != nil {
+		return l.conf.Default, ""
+	}
+
+	for _, key := range []string{r.Method + " " + tpl, tpl} {
+		if p, ok := l.conf.Routes[key]; ok {
+			return p, key
+		}
+	}
+
+	for _, prefix := range l.prefixes {
+		path := tpl
+		if strings.Contains(prefix, " ") {
+			path = r.Method + " " + tpl
+		}
+
+		if strings.HasPrefix(path, strings.TrimSuffix(prefix, "*")) {
+			return l.conf.Routes[prefix], prefix
+		}
+	}
+
+	return l.conf.Default, ""
+}
+
+func (l *rateLimiter) isTrusted(ip net.IP) bool {
+	for _, n := range l.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIP returns address of the client. ClientIPHeader is used only when
+// the request comes from a trusted proxy, the rightmost untrusted address of
+// X-Forwarded-For is the one added by the outermost trusted proxy.
+func (l *rateLimiter) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !l.isTrusted(ip) || l.conf.ClientIPHeader == "" {
+		return host
+	}
+
+	header := r.Header.Get(l.conf.ClientIPHeader)
+	if header == "" {
+		return host
+	}
+
+	hops := strings.Split(header, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+
+		host = hop.String()
+		if !l.isTrusted(hop) {
+			break
+		}
+	}
+
+	return host
+}
+
+// subject returns what the request is counted by under policy p
+func (s *Server) subject(r *http.Request, p RateLimitPolicy) string {
+	switch p.Key {
+	case RateLimitByUser:
+		if token := getAuthorizationToken(r); token != "" {
+			if p, err := s.authenticate(r.Context(), token); err == nil && p != nil {
+				return "user:" + p.UID
+			}
+		}
+	case RateLimitByApp:
+		// Client IDs sent with the request aren't verified yet, counting
+		// by them would let clients pick a fresh bucket for every request
+		if token := getAuthorizationToken(r); token != "" {
+			if p, err := s.authenticate(r.Context(), token); err == nil && p != nil && p.AppID != "" {
+				return "app:" + p.AppID
+			}
+		}
+	}
+
+	return "ip:" + s.limiter.clientIP(r)
+}
+
+// seconds rounds d up to whole seconds for headers
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// rateLimit rejects requests which exceed policy of their route with 429. If
+// the store fails, requests are let through.
+func (s *Server) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, group := s.limiter.policy(r)
+		if !p.Enabled() || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		res, err := s.limiter.store.Take(r.Context(), group+"|"+s.subject(r, p), p)
+		if err != nil {
+			logger(r.Context()).WithError(err).Error("can't check rate limit")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(p.capacity()))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		w.Header().Set("X-RateLimit-Reset", seconds(res.Reset))
+		if !res.Allowed {
+			w.Header().Set("Retry-After", seconds(res.RetryAfter))
+			writeError(w, r, http.StatusTooManyRequests, "")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SetRateLimitStore replaces the in-memory store of rate limit buckets, e.g.
+// with one shared by replicas of the gateway
+func (s *Server) SetRateLimitStore(store RateLimitStore) {
+	s.limiter.store = store
+}
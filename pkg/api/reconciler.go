@@ -0,0 +1,299 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	post "github.com/andreymgn/RSOI-post/pkg/post/proto"
+	poststats "github.com/andreymgn/RSOI-poststats/pkg/poststats/proto"
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	discrepancyMissingStats     = "missing-stats"
+	discrepancyOrphanedStats    = "orphaned-stats"
+	discrepancyOrphanedComments = "orphaned-comments"
+
+	// reconcileGracePeriod protects posts which are still being created from
+	// being reported as lacking stats
+	reconcileGracePeriod = time.Minute
+)
+
+var errReconcileRunning = errors.New("reconciliation is already running")
+
+type discrepancy struct {
+	Kind     string
+	PostUID  string
+	Details  string
+	Repaired bool
+	Error    string `json:",omitempty"`
+}
+
+type reconcileReport struct {
+	StartedAt     time.Time
+	FinishedAt    time.Time
+	Repair        bool
+	PostsChecked  int
+	Discrepancies []discrepancy
+	Error         string `json:",omitempty"`
+}
+
+// reconciler finds and optionally repairs inconsistencies between the post,
+// poststats and comment services left by partially failed requests
+type reconciler struct {
+	mu      sync.Mutex
+	running bool
+	last    *reconcileReport
+}
+
+// reconcile runs a single reconciliation unless one is already running. The
+// returned error says why the run didn't finish, it is kept in the report too.
+func (s *Server) reconcile(ctx context.Context, repair bool) error {
+	s.reconciler.mu.Lock()
+	if s.reconciler.running {
+		s.reconciler.mu.Unlock()
+		return errReconcileRunning
+	}
+	s.reconciler.running = true
+	s.reconciler.mu.Unlock()
+
+	report := &reconcileReport{StartedAt: time.Now(), Repair: repair, Discrepancies: make([]discrepancy, 0)}
+	var errs []string
+	if err := s.reconcileLivePosts(ctx, report); err != nil {
+		errs = append(errs, "live posts: "+err.Error())
+	}
+	if err := s.reconcileDeletedPosts(ctx, report); err != nil {
+		errs = append(errs, "deleted posts: "+err.Error())
+	}
+	report.Error = strings.Join(errs, "; ")
+	report.FinishedAt = time.Now()
+
+	s.reconciler.mu.Lock()
+	s.reconciler.running = false
+	s.reconciler.last = report
+	s.reconciler.mu.Unlock()
+
+	if report.Error != "" {
+		return errors.New(report.Error)
+	}
+
+	log.WithFields(log.Fields{
+		"posts_checked": report.PostsChecked,
+		"discrepancies": len(report.Discrepancies),
+		"repair":        repair,
+	}).Info("reconciliation finished")
+	return nil
+}
+
+// reconcileLivePosts finds existing posts which have no stats
+func (s *Server) reconcileLivePosts(ctx context.Context, report *reconcileReport) error {
+	posts := make(map[string]*post.SinglePost)
+	uids, err := listPages(func(page int32) ([]string, error) {
+		postResponse, err := s.postClient.client.ListPosts(ctx,
+			&post.ListPostsRequest{PageSize: cascadePageSize, PageNumber: page},
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		uids := make([]string, len(postResponse.Posts))
+		for i, p := range postResponse.Posts {
+			uids[i] = p.Uid
+			posts[p.Uid] = p
+		}
+		return uids, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	pending := s.outbox.pendingUIDs(deletePostQueue)
+	for _, uid := range uids {
+		report.PostsChecked++
+
+		// Post is being deleted or rolled back
+		if pending[uid] {
+			continue
+		}
+
+		createdAt, err := ptypes.Timestamp(posts[uid].CreatedAt)
+		if err != nil || time.Since(createdAt) < reconcileGracePeriod {
+			continue
+		}
+
+		_, err = s.postStatsClient.client.GetPostStats(ctx,
+			&poststats.GetPostStatsRequest{PostUid: uid},
+		)
+		if status.Code(err) != codes.NotFound {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		d := discrepancy{Kind: discrepancyMissingStats, PostUID: uid}
+		if report.Repair {
+			_, err := s.postStatsClient.client.CreatePostStats(ctx,
+				&poststats.CreatePostStatsRequest{PostUid: uid},
+			)
+			d.Repaired = err == nil
+			if err != nil {
+				d.Error = err.Error()
+			}
+		}
+		report.Discrepancies = append(report.Discrepancies, d)
+	}
+
+	return nil
+}
+
+// reconcileDeletedPosts finds stats and comments left behind by posts which
+// the gateway has deleted, including rolled back ones. The post service
+// decides whether a post is gone. Posts are checked on every run until
+// nothing is left of them. Posts whose stats or comments are still being
+// deleted are skipped.
+func (s *Server) reconcileDeletedPosts(ctx context.Context, report *reconcileReport) error {
+	pendingStats := s.outbox.pendingUIDs(deletePostStatsQueue)
+	pendingComments := s.outbox.pendingUIDs(deletePostCommentsQueue)
+	for _, uid := range s.outbox.deletedUIDs(deletePostQueue) {
+		if pendingStats[uid] || pendingComments[uid] {
+			continue
+		}
+
+		exists, err := s.postClient.client.CheckPostExists(ctx,
+			&post.CheckPostExistsRequest{Uid: uid},
+		)
+		if err != nil {
+			return err
+		}
+
+		// Live posts are checked by reconcileLivePosts
+		clean := true
+		if !exists.Exists {
+			_, err = s.postStatsClient.client.GetPostStats(ctx,
+				&poststats.GetPostStatsRequest{PostUid: uid},
+			)
+			if err == nil {
+				clean = false
+				d := discrepancy{Kind: discrepancyOrphanedStats, PostUID: uid}
+				if report.Repair {
+					d.Repaired, d.Error = s.repairWith(ctx, newWorkerRequest(deletePostStatsQueue, uid))
+				}
+				report.Discrepancies = append(report.Discrepancies, d)
+			} else if status.Code(err) != codes.NotFound {
+				return err
+			}
+
+			uids, err := listCommentUIDs(ctx, s.commentClient.client, uid)
+			if err != nil {
+				return err
+			}
+
+			if len(uids) > 0 {
+				clean = false
+				d := discrepancy{Kind: discrepancyOrphanedComments, PostUID: uid, Details: strconv.Itoa(len(uids)) + " comments"}
+				if report.Repair {
+					d.Repaired, d.Error = s.repairWith(ctx, newWorkerRequest(deletePostCommentsQueue, uid))
+				}
+				report.Discrepancies = append(report.Discrepancies, d)
+			}
+		}
+
+		if clean {
+			if err := s.outbox.forgetDeleted(deletePostQueue, uid); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// repairWith hands repair of a discrepancy to the deletion workers
+func (s *Server) repairWith(ctx context.Context, req workerRequest) (bool, string) {
+	if err := s.enqueue(ctx, req); err != nil {
+		return false, err.Error()
+	}
+
+	return true, ""
+}
+
+// runReconciler reconciles every interval until ctx is done
+func (s *Server) runReconciler(ctx, jobCtx context.Context, interval time.Duration, repair bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.reconcile(jobCtx, repair); err != nil {
+				log.WithError(err).Warn("reconciliation failed")
+			}
+		}
+	}
+}
+
+func (s *Server) getReconcileReport() http.HandlerFunc {
+	type response struct {
+		Running bool
+		Last    *reconcileReport `json:",omitempty"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.reconciler.mu.Lock()
+		resp := response{s.reconciler.running, s.reconciler.last}
+		json, err := json.Marshal(resp)
+		s.reconciler.mu.Unlock()
+		if err != nil {
+			handleRPCError(w, r, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write(json)
+	}
+}
+
+func (s *Server) startReconcile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		repair := false
+		if s := r.URL.Query().Get("repair"); s != "" {
+			var err error
+			repair, err = strconv.ParseBool(s)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, "can't parse query parameter `repair`")
+				return
+			}
+		}
+
+		s.reconciler.mu.Lock()
+		running := s.reconciler.running
+		s.reconciler.mu.Unlock()
+		if running {
+			writeError(w, r, http.StatusConflict, errReconcileRunning.Error())
+			return
+		}
+
+		s.workers.Add(1)
+		go func() {
+			defer s.workers.Done()
+			if err := s.reconcile(s.jobCtx, repair); err != nil {
+				log.WithError(err).Warn("reconciliation failed")
+			}
+		}()
+
+		w.Header().Set("Location", "/api/admin/reconcile")
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
@@ -4,40 +4,59 @@ import "net/http"
 
 func (s *Server) routes() {
 	categoryRouter := s.router.Mux.PathPrefix("/api/categories").Subrouter()
-	categoryRouter.HandleFunc("/", s.getCategories()).Methods("GET")
-	categoryRouter.HandleFunc("/{uid}", s.getCategoryInfo()).Methods("GET")
-	categoryRouter.HandleFunc("/", s.createCategory()).Methods("POST")
-	s.router.Mux.HandleFunc("/api/posts", s.getPosts()).Methods("GET")
-	categoryRouter.HandleFunc("/{uid}/posts", s.getPostsByCategory()).Methods("GET")
-	categoryRouter.HandleFunc("/{uid}/posts", s.createPost()).Methods("POST")
-	categoryRouter.HandleFunc("/{uid}/reports", s.getReports()).Methods("GET")
-	categoryRouter.HandleFunc("/{categoryuid}/reports/{uid}", s.deleteReport()).Methods("DELETE")
-
-	categoryRouter.HandleFunc("/{categoryuid}/posts/{uid}", s.getPost()).Methods("GET")
-	categoryRouter.HandleFunc("/{categoryuid}/posts/{uid}", s.updatePost()).Methods("PATCH")
-	categoryRouter.HandleFunc("/{categoryuid}/posts/{uid}", s.deletePost()).Methods("DELETE")
-	categoryRouter.HandleFunc("/{categoryuid}/posts/{uid}/report", s.reportPost()).Methods("POST")
-
-	categoryRouter.HandleFunc("/{categoryuid}/posts/{uid}/like", s.likePost()).Methods("PATCH")
-	categoryRouter.HandleFunc("/{categoryuid}/posts/{uid}/dislike", s.dislikePost()).Methods("PATCH")
-
-	categoryRouter.HandleFunc("/{categoryuid}/posts/{postuid}/comments/", s.getPostComments()).Methods("GET")
-	categoryRouter.HandleFunc("/{categoryuid}/posts/{postuid}/comments/", s.createComment()).Methods("POST")
-	categoryRouter.HandleFunc("/{categoryuid}/posts/{postuid}/comments/{uid}", s.getPostComments()).Methods("GET")
-	categoryRouter.HandleFunc("/{categoryuid}/posts/{postuid}/comments/{uid}/single", s.getSingleComment()).Methods("GET")
-	categoryRouter.HandleFunc("/{categoryuid}/posts/{postuid}/comments/{uid}", s.updateComment()).Methods("PATCH")
-	categoryRouter.HandleFunc("/{categoryuid}/posts/{postuid}/comments/{uid}", s.deleteComment()).Methods("DELETE")
-	categoryRouter.HandleFunc("/{categoryuid}/posts/{postuid}/comments/{uid}/report", s.reportComment()).Methods("POST")
+	categoryRouter.HandleFunc("/", s.optionalAuth(s.getCategories())).Methods("GET")
+	categoryRouter.HandleFunc("/{uid}", s.optionalAuth(s.getCategoryInfo())).Methods("GET")
+	categoryRouter.HandleFunc("/", s.requireAuth(s.createCategory())).Methods("POST")
+	categoryRouter.HandleFunc("/{uid}", s.authorize(anyOf(categoryModerator("uid"), globalAdmin), s.deleteCategory())).Methods("DELETE")
+	s.router.Mux.HandleFunc("/api/posts", s.optionalAuth(s.getPosts())).Methods("GET")
+	categoryRouter.HandleFunc("/{uid}/posts", s.optionalAuth(s.getPostsByCategory())).Methods("GET")
+	categoryRouter.HandleFunc("/{uid}/posts", s.requireAuth(s.createPost())).Methods("POST")
+	categoryRouter.HandleFunc("/{uid}/reports", s.authorize(anyOf(categoryModerator("uid")), s.getReports())).Methods("GET")
+	categoryRouter.HandleFunc("/{categoryuid}/reports/{uid}", s.authorize(anyOf(reportModerator("categoryuid", "uid")), s.deleteReport())).Methods("DELETE")
+
+	categoryRouter.HandleFunc("/{categoryuid}/posts/{uid}", s.optionalAuth(s.getPost())).Methods("GET")
+	categoryRouter.HandleFunc("/{categoryuid}/posts/{uid}", s.authorize(anyOf(postOwner("uid")), s.updatePost())).Methods("PATCH")
+	categoryRouter.HandleFunc("/{categoryuid}/posts/{uid}", s.authorize(anyOf(postOwner("uid"), postModerator("uid"), globalAdmin), s.deletePost())).Methods("DELETE")
+	categoryRouter.HandleFunc("/{categoryuid}/posts/{uid}/report", s.requireAuth(s.reportPost())).Methods("POST")
+
+	categoryRouter.HandleFunc("/{categoryuid}/posts/{uid}/like", s.requireAuth(s.likePost())).Methods("PATCH")
+	categoryRouter.HandleFunc("/{categoryuid}/posts/{uid}/dislike", s.requireAuth(s.dislikePost())).Methods("PATCH")
+
+	categoryRouter.HandleFunc("/{categoryuid}/posts/{postuid}/comments/", s.optionalAuth(s.getPostComments())).Methods("GET")
+	categoryRouter.HandleFunc("/{categoryuid}/posts/{postuid}/comments/", s.requireAuth(s.createComment())).Methods("POST")
+	categoryRouter.HandleFunc("/{categoryuid}/posts/{postuid}/comments/{uid}", s.optionalAuth(s.getPostComments())).Methods("GET")
+	categoryRouter.HandleFunc("/{categoryuid}/posts/{postuid}/comments/{uid}/single", s.optionalAuth(s.getSingleComment())).Methods("GET")
+	categoryRouter.HandleFunc("/{categoryuid}/posts/{postuid}/comments/{uid}", s.authorize(anyOf(commentOwner("uid")), s.updateComment())).Methods("PATCH")
+	categoryRouter.HandleFunc("/{categoryuid}/posts/{postuid}/comments/{uid}", s.authorize(anyOf(commentOwner("uid"), commentModerator("uid"), globalAdmin), s.deleteComment())).Methods("DELETE")
+	categoryRouter.HandleFunc("/{categoryuid}/posts/{postuid}/comments/{uid}/report", s.requireAuth(s.reportComment())).Methods("POST")
 
 	s.router.Mux.HandleFunc("/api/user", s.createUser()).Methods("POST")
-	s.router.Mux.HandleFunc("/api/user/{uid}", s.getUserInfo()).Methods("GET")
+	s.router.Mux.HandleFunc("/api/user/{uid}", s.optionalAuth(s.getUserInfo())).Methods("GET")
+	s.router.Mux.HandleFunc("/api/user/{uid}", s.authorize(anyOf(self("uid"), globalAdmin), s.deleteUser())).Methods("DELETE")
 	s.router.Mux.HandleFunc("/api/auth/token", s.getToken()).Methods("POST")
 	s.router.Mux.HandleFunc("/api/auth/refresh", s.refreshToken()).Methods("POST")
 
-	s.router.Mux.HandleFunc("/api/oauth/app", s.createApp()).Methods("POST")
-	s.router.Mux.HandleFunc("/api/oauth/app/{uid}", s.getAppInfo()).Methods("GET")
+	s.router.Mux.HandleFunc("/api/oauth/app", s.requireAuth(s.createApp())).Methods("POST")
+	s.router.Mux.HandleFunc("/api/oauth/app/{uid}", s.optionalAuth(s.getAppInfo())).Methods("GET")
 	s.router.Mux.HandleFunc("/api/oauth/authorize", s.getOAuthCode()).Methods("POST")
-	s.router.Mux.HandleFunc("/api/oauth/token", s.getTokenFromOAuthCode()).Methods("GET")
+	s.router.Mux.HandleFunc("/api/oauth/token", s.oauthToken()).Methods("POST")
+
+	s.router.Mux.HandleFunc("/api/jobs/{id}", s.authorize(anyOf(jobOwner("id"), globalAdmin), s.getJob())).Methods("GET")
+
+	s.router.Mux.HandleFunc("/api/admin/jobs", s.authorize(anyOf(globalAdmin), s.getJobs())).Methods("GET")
+	s.router.Mux.HandleFunc("/api/admin/jobs/{id}/replay", s.authorize(anyOf(globalAdmin), s.replayJob())).Methods("POST")
+	s.router.Mux.HandleFunc("/api/admin/jobs/{id}", s.authorize(anyOf(globalAdmin), s.deleteJob())).Methods("DELETE")
+	s.router.Mux.HandleFunc("/api/admin/reconcile", s.authorize(anyOf(globalAdmin), s.getReconcileReport())).Methods("GET")
+	s.router.Mux.HandleFunc("/api/admin/reconcile", s.authorize(anyOf(globalAdmin), s.startReconcile())).Methods("POST")
+
+	s.router.Mux.HandleFunc("/healthz", s.healthz()).Methods("GET")
+	s.router.Mux.HandleFunc("/readyz", s.readyz()).Methods("GET")
 
 	s.router.Mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("Hello, world!")) })
+	s.router.Mux.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusNotFound, "no route matches "+r.URL.Path)
+	})
+	s.router.Mux.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path)
+	})
 }
@@ -2,12 +2,14 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	opentracing "github.com/opentracing/opentracing-go"
@@ -18,13 +20,7 @@ import (
 	poststats "github.com/andreymgn/RSOI-poststats/pkg/poststats/proto"
 	user "github.com/andreymgn/RSOI-user/pkg/user/proto"
 	"github.com/andreymgn/RSOI/pkg/tracer"
-	"github.com/rs/cors"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
-)
-
-const (
-	MaxQueueLength = 100
+	log "github.com/sirupsen/logrus"
 )
 
 type PostClient struct {
@@ -47,31 +43,192 @@ type UserClient struct {
 	client user.UserClient
 }
 
+// HTTPConfig controls the HTTP server
+type HTTPConfig struct {
+	// Addr is the address the server listens on
+	Addr string
+	// MetricsAddr is the address /metrics is served on, apart from the API
+	// so that it can be kept private. Empty disables it.
+	MetricsAddr  string
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// ShutdownTimeout is how long in-flight requests may take after shutdown
+	// begins
+	ShutdownTimeout time.Duration
+	// RouteTimeout is the deadline of backend calls made for a request,
+	// zero disables it
+	RouteTimeout time.Duration
+	// RouteTimeouts overrides RouteTimeout for routes given by path
+	// template, optionally preceded by method, e.g. "GET /api/posts"
+	RouteTimeouts map[string]time.Duration
+	// ReadinessTimeout bounds health checks of backends made by /readyz
+	ReadinessTimeout time.Duration
+	CORS             CORSConfig
+	// CORSOverrides replaces CORS policy for paths starting with the key,
+	// e.g. "/api/oauth/"
+	CORSOverrides map[string]CORSConfig
+	TLS           TLSConfig
+	RateLimit     RateLimitConfig
+	Auth          AuthConfig
+}
+
+// DefaultHTTPConfig returns HTTPConfig with sensible defaults
+func DefaultHTTPConfig() HTTPConfig {
+	return HTTPConfig{
+		Addr:             ":8080",
+		MetricsAddr:      ":9090",
+		ReadTimeout:      time.Second * 15,
+		WriteTimeout:     time.Second * 15,
+		IdleTimeout:      time.Second * 60,
+		ShutdownTimeout:  time.Second * 15,
+		RouteTimeout:     time.Second * 10,
+		ReadinessTimeout: time.Second * 2,
+		CORS:             DefaultCORSConfig(),
+		TLS:              TLSConfig{MinVersion: "1.2"},
+		RateLimit:        DefaultRateLimitConfig(),
+		Auth:             DefaultAuthConfig(),
+	}
+}
+
 type Server struct {
-	router                 *tracer.TracedRouter
-	postClient             *PostClient
-	categoryClient         *CategoryClient
-	commentClient          *CommentClient
-	postStatsClient        *PostStatsClient
-	userClient             *UserClient
-	deletePostChannel      chan workerRequest
-	deletePostStatsChannel chan workerRequest
-	deleteCommentChannel   chan workerRequest
+	router          *tracer.TracedRouter
+	postClient      *PostClient
+	categoryClient  *CategoryClient
+	commentClient   *CommentClient
+	postStatsClient *PostStatsClient
+	userClient      *UserClient
+	httpConfig      HTTPConfig
+	workerConfig    WorkerConfig
+	queues          map[string]*jobQueue
+	outbox          *outbox
+	reconciler      *reconciler
+	workers         sync.WaitGroup
+	jobCtx          context.Context
+	backends        []backend
+	metrics         *metrics
+	limiter         *rateLimiter
+	tokens          *tokenCache
+	verifier        *tokenVerifier
+	lookups         *lookupCache
 }
 
-// NewServer returns new instance of Server
-func NewServer(pc post.PostClient, catc category.CategoryClient, cc comment.CommentClient, psc poststats.PostStatsClient, uc user.UserClient, tr opentracing.Tracer) *Server {
-	return &Server{
+// NewServer returns new instance of Server. Zero fields of wc are replaced
+// with defaults.
+func NewServer(pc post.PostClient, catc category.CategoryClient, cc comment.CommentClient, psc poststats.PostStatsClient, uc user.UserClient, tr opentracing.Tracer, hc HTTPConfig, wc WorkerConfig) (*Server, error) {
+	if hc.Addr == "" {
+		return nil, errors.New("listen address is not set")
+	}
+	if hc.ReadinessTimeout <= 0 {
+		hc.ReadinessTimeout = DefaultHTTPConfig().ReadinessTimeout
+	}
+	if hc.TLS.MinVersion == "" {
+		hc.TLS.MinVersion = DefaultHTTPConfig().TLS.MinVersion
+	}
+	if hc.TLS.Enabled() && (hc.TLS.CertFile == "" || hc.TLS.KeyFile == "") {
+		return nil, errors.New("both TLS certificate and key files must be set")
+	}
+	if hc.MetricsAddr != "" && hc.MetricsAddr == hc.Addr {
+		return nil, errors.New("metrics must be served on a different address than the API")
+	}
+	if hc.TLS.RedirectAddr != "" && !hc.TLS.Enabled() {
+		return nil, errors.New("HTTPS redirect requires TLS to be enabled")
+	}
+	if _, err := ParseTLSVersion(hc.TLS.MinVersion); err != nil {
+		return nil, err
+	}
+	if _, err := ParseCipherSuites(hc.TLS.CipherSuites); err != nil {
+		return nil, err
+	}
+	limiter, err := newRateLimiter(hc.RateLimit)
+	if err != nil {
+		return nil, err
+	}
+	if hc.Auth.AccessTokenTTL <= 0 {
+		hc.Auth.AccessTokenTTL = DefaultAuthConfig().AccessTokenTTL
+	}
+	var verifier *tokenVerifier
+	if hc.Auth.JWT.Enabled() {
+		if hc.Auth.JWT.JWKSRefresh <= 0 {
+			hc.Auth.JWT.JWKSRefresh = DefaultAuthConfig().JWT.JWKSRefresh
+		}
+		if verifier, err = newTokenVerifier(hc.Auth.JWT); err != nil {
+			return nil, err
+		}
+	}
+
+	defaults := DefaultWorkerConfig()
+	if wc.OutboxPath == "" {
+		wc.OutboxPath = defaults.OutboxPath
+	}
+	if wc.MaxAttempts <= 0 {
+		wc.MaxAttempts = defaults.MaxAttempts
+	}
+	if wc.BaseBackoff <= 0 {
+		wc.BaseBackoff = defaults.BaseBackoff
+	}
+	if wc.MaxBackoff <= 0 {
+		wc.MaxBackoff = defaults.MaxBackoff
+	}
+	if wc.AccountPostPolicy == "" {
+		wc.AccountPostPolicy = defaults.AccountPostPolicy
+	}
+	if wc.AccountPostPolicy != DeletePosts && wc.AccountPostPolicy != AnonymizePosts {
+		return nil, fmt.Errorf("unknown account post policy %q", wc.AccountPostPolicy)
+	}
+	if wc.Workers <= 0 {
+		wc.Workers = defaults.Workers
+	}
+	if wc.DrainTimeout <= 0 {
+		wc.DrainTimeout = defaults.DrainTimeout
+	}
+
+	queues := make(map[string]*jobQueue, len(queueNames))
+	for _, name := range queueNames {
+		queues[name] = newJobQueue()
+	}
+
+	for name, n := range wc.QueueWorkers {
+		if _, ok := queues[name]; !ok {
+			return nil, fmt.Errorf("workers configured for unknown queue %q", name)
+		}
+
+		if n < 0 {
+			return nil, fmt.Errorf("negative number of workers for queue %q", name)
+		}
+	}
+
+	// The outbox is opened once the configuration is known to be valid, so that
+	// an error doesn't leave it open
+	ob, err := openOutbox(wc.OutboxPath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
 		tracer.NewRouter(tr),
 		&PostClient{pc},
 		&CategoryClient{catc},
 		&CommentClient{cc},
 		&PostStatsClient{psc},
 		&UserClient{uc},
-		make(chan workerRequest, MaxQueueLength),
-		make(chan workerRequest, MaxQueueLength),
-		make(chan workerRequest, MaxQueueLength),
+		hc,
+		wc,
+		queues,
+		ob,
+		&reconciler{},
+		sync.WaitGroup{},
+		nil,
+		nil,
+		newMetrics(),
+		limiter,
+		newTokenCache(hc.Auth),
+		verifier,
+		newLookupCache(hc.Auth),
 	}
+	s.metrics.registry.MustRegister(newQueueCollector(s), newBreakerCollector(s))
+
+	return s, nil
 }
 
 func getAuthorizationToken(r *http.Request) string {
@@ -84,30 +241,6 @@ func getAuthorizationToken(r *http.Request) string {
 	return ""
 }
 
-func handleRPCError(w http.ResponseWriter, err error) {
-	log.Println("API err:", err)
-	st, ok := status.FromError(err)
-	if !ok {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	switch st.Code() {
-	case codes.NotFound:
-		http.Error(w, st.Message(), http.StatusNotFound)
-	case codes.InvalidArgument:
-		http.Error(w, st.Message(), http.StatusUnprocessableEntity)
-	case codes.Unauthenticated:
-		w.WriteHeader(http.StatusForbidden)
-	case codes.Unavailable:
-		w.WriteHeader(http.StatusServiceUnavailable)
-	case codes.AlreadyExists:
-		http.Error(w, st.Message(), http.StatusConflict)
-	default:
-		w.WriteHeader(http.StatusInternalServerError)
-	}
-}
-
 func setContentType(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Content-Type", "application/json")
@@ -115,43 +248,153 @@ func setContentType(next http.Handler) http.Handler {
 	})
 }
 
-// Start starts HTTP server which can shut down gracefully
-func (s *Server) Start(port int) {
-	c := cors.New(cors.Options{
-		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PATCH", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Origin", "X-Requested-With", "Content-Type", "Accept", "Access-Control-Allow-Origin", "Authorization"},
-		AllowCredentials: true,
-	})
-	s.router.Mux.Use(setContentType)
+// Start starts HTTP server, HTTPS if it is configured, and background
+// workers. On SIGINT or SIGTERM it
+// stops accepting requests, lets workers finish in-flight jobs within
+// WorkerConfig.DrainTimeout and returns. Jobs which did not finish stay in the
+// outbox and are run after restart.
+func (s *Server) Start() error {
+	s.router.Mux.Use(s.instrument, setContentType, s.routeTimeout, s.rateLimit)
 	s.routes()
 	srv := &http.Server{
-		Addr:         fmt.Sprintf(":%d", port),
-		WriteTimeout: time.Second * 15,
-		ReadTimeout:  time.Second * 15,
-		IdleTimeout:  time.Second * 60,
-		Handler:      c.Handler(s.router),
+		Addr:         s.httpConfig.Addr,
+		WriteTimeout: s.httpConfig.WriteTimeout,
+		ReadTimeout:  s.httpConfig.ReadTimeout,
+		IdleTimeout:  s.httpConfig.IdleTimeout,
+		Handler:      requestID(s.cors(s.router)),
+	}
+
+	var certs *certReloader
+	if s.httpConfig.TLS.Enabled() {
+		var err error
+		certs, err = newCertReloader(s.httpConfig.TLS.CertFile, s.httpConfig.TLS.KeyFile)
+		if err != nil {
+			s.outbox.close()
+			return err
+		}
+
+		srv.TLSConfig, err = newTLSConfig(s.httpConfig.TLS, certs)
+		if err != nil {
+			s.outbox.close()
+			return err
+		}
 	}
 
-	go s.deletePostWorker()
-	go s.deletePostStatsWorker()
-	go s.deleteCommentWorker()
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
 
+	jobCtx, abortJobs := context.WithCancel(context.Background())
+	defer abortJobs()
+	s.jobCtx = jobCtx
+
+	if s.verifier != nil {
+		go s.verifier.watch(workerCtx)
+	}
+
+	s.replayOutbox()
+	s.startWorkers(workerCtx, jobCtx)
+	if s.workerConfig.ReconcileInterval > 0 {
+		s.workers.Add(1)
+		go func() {
+			defer s.workers.Done()
+			s.runReconciler(workerCtx, jobCtx, s.workerConfig.ReconcileInterval, s.workerConfig.ReconcileRepair)
+		}()
+	}
+
+	serverErr := make(chan error, 3)
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			log.Println(err)
+		if certs != nil {
+			serverErr <- srv.ListenAndServeTLS("", "")
+			return
 		}
+
+		serverErr <- srv.ListenAndServe()
 	}()
 
+	var redirect *http.Server
+	if certs != nil {
+		go certs.watch(workerCtx)
+
+		if s.httpConfig.TLS.RedirectAddr != "" {
+			redirect = &http.Server{
+				Addr:         s.httpConfig.TLS.RedirectAddr,
+				WriteTimeout: s.httpConfig.WriteTimeout,
+				ReadTimeout:  s.httpConfig.ReadTimeout,
+				IdleTimeout:  s.httpConfig.IdleTimeout,
+				Handler:      redirectToHTTPS(s.httpConfig.Addr),
+			}
+			go func() {
+				serverErr <- redirect.ListenAndServe()
+			}()
+		}
+	}
+
+	var metrics *http.Server
+	if s.httpConfig.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", s.metricsHandler())
+		metrics = &http.Server{
+			Addr:         s.httpConfig.MetricsAddr,
+			WriteTimeout: s.httpConfig.WriteTimeout,
+			ReadTimeout:  s.httpConfig.ReadTimeout,
+			IdleTimeout:  s.httpConfig.IdleTimeout,
+			Handler:      mux,
+		}
+		go func() {
+			serverErr <- metrics.ListenAndServe()
+		}()
+	}
+
 	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(ch)
 
-	signal.Notify(ch, os.Interrupt)
-	<-ch
+	var err error
+	select {
+	case sig := <-ch:
+		log.WithField("signal", sig.String()).Info("shutting down")
+	case err = <-serverErr:
+		log.WithError(err).Error("HTTP server stopped")
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	ctx, cancel := context.WithTimeout(context.Background(), s.httpConfig.ShutdownTimeout)
 	defer cancel()
 
-	srv.Shutdown(ctx)
-	log.Println("shutting down")
-	os.Exit(0)
+	if shutdownErr := srv.Shutdown(ctx); shutdownErr != nil && err == nil {
+		err = shutdownErr
+	}
+
+	if redirect != nil {
+		if shutdownErr := redirect.Shutdown(ctx); shutdownErr != nil && err == nil {
+			err = shutdownErr
+		}
+	}
+
+	if metrics != nil {
+		if shutdownErr := metrics.Shutdown(ctx); shutdownErr != nil && err == nil {
+			err = shutdownErr
+		}
+	}
+
+	stopWorkers()
+	drained := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(s.workerConfig.DrainTimeout):
+		log.WithField("timeout", s.workerConfig.DrainTimeout.String()).Warn("drain timeout exceeded, aborting in-flight jobs")
+		abortJobs()
+		<-drained
+	}
+
+	if closeErr := s.outbox.close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+
+	log.Info("shut down")
+	return err
 }
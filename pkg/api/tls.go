@@ -0,0 +1,246 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certPollInterval is how often certificate files are checked for changes
+const certPollInterval = time.Second * 10
+
+// TLSConfig controls HTTPS on the public listener
+type TLSConfig struct {
+	// CertFile and KeyFile enable HTTPS when set. They are reloaded when
+	// they change or the process receives SIGHUP.
+	CertFile string
+	KeyFile  string
+	// MinVersion is the lowest accepted TLS version, e.g. "1.2"
+	MinVersion string
+	// CipherSuites restricts cipher suites used with TLS 1.2 and below,
+	// empty list allows Go defaults
+	CipherSuites []string
+	// RedirectAddr is the address of a plain HTTP listener redirecting to
+	// HTTPS, empty string disables it
+	RedirectAddr string
+}
+
+// Enabled reports whether HTTPS is configured
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+}
+
+var cipherSuites = map[string]uint16{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+}
+
+// ParseTLSVersion converts version such as "1.2" to its crypto/tls constant
+func ParseTLSVersion(s string) (uint16, error) {
+	v, ok := tlsVersions[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, expected 1.0, 1.1 or 1.2", s)
+	}
+
+	return v, nil
+}
+
+// ParseCipherSuites converts cipher suite names to their crypto/tls constants
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	var result []uint16
+	for _, name := range names {
+		id, ok := cipherSuites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		result = append(result, id)
+	}
+
+	return result, nil
+}
+
+// fileReloader calls load when any of the files changes or the process
+// receives SIGHUP. If load fails, whatever was loaded before stays in use.
+type fileReloader struct {
+	// name says what the files hold in log messages
+	name  string
+	paths []string
+	load  func() error
+
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+// modified returns the latest modification time of the files
+func (r *fileReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range r.paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+func (r *fileReloader) reload() error {
+	modTime, err := r.modified()
+	if err != nil {
+		return err
+	}
+
+	if err := r.load(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.modTime = modTime
+	r.mu.Unlock()
+	return nil
+}
+
+// changed reports whether the files were modified since they were loaded
+func (r *fileReloader) changed() bool {
+	modTime, err := r.modified()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return err != nil || modTime.After(r.modTime)
+}
+
+// watch reloads the files until ctx is done
+func (r *fileReloader) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(certPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+		}
+
+		entry := log.WithField("files", r.paths)
+		if err := r.reload(); err != nil {
+			entry.WithError(err).Error("can't reload " + r.name + ", keeping the previous ones")
+			continue
+		}
+		entry.Info("reloaded " + r.name)
+	}
+}
+
+// certReloader serves the certificate from files which may be replaced while
+// the server is running, e.g. by a certificate manager. Established
+// connections keep the certificate they were started with.
+type certReloader struct {
+	*fileReloader
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{}
+	r.fileReloader = &fileReloader{name: "TLS files", paths: []string{certFile, keyFile}, load: func() error {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+
+		r.mu.Lock()
+		r.cert = &cert
+		r.mu.Unlock()
+		return nil
+	}}
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+// newTLSConfig returns server TLS configuration which takes certificate from r
+func newTLSConfig(c TLSConfig, r *certReloader) (*tls.Config, error) {
+	minVersion, err := ParseTLSVersion(c.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	suites, err := ParseCipherSuites(c.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		GetCertificate:           r.getCertificate,
+		MinVersion:               minVersion,
+		CipherSuites:             suites,
+		PreferServerCipherSuites: true,
+	}, nil
+}
+
+// redirectToHTTPS returns handler which redirects requests to the same URL
+// served by HTTPS listener at addr
+func redirectToHTTPS(addr string) http.Handler {
+	_, port, _ := net.SplitHostPort(addr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -25,14 +25,14 @@ func (s *Server) getUserInfo() http.HandlerFunc {
 			&user.GetUserInfoRequest{Uid: uid},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		resp := response{getUserResponse.Uid, getUserResponse.Username}
 		json, err := json.Marshal(resp)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -41,6 +41,40 @@ func (s *Server) getUserInfo() http.HandlerFunc {
 	}
 }
 
+func (s *Server) deleteUser() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUID := principalFrom(r.Context()).UID
+
+		vars := mux.Vars(r)
+		uid := vars["uid"]
+
+		ctx := r.Context()
+		_, err := s.userClient.client.GetUserInfo(ctx,
+			&user.GetUserInfoRequest{Uid: uid},
+		)
+		if err != nil {
+			handleRPCError(w, r, err)
+			return
+		}
+
+		c := newCascade(cascadeDeleteAccount, uid, userUID)
+		// The account goes last, its content is listed by the owner UID and the
+		// steps must be retryable until everything is gone
+		err = s.startCascade(r.Context(), c, []workerRequest{
+			newWorkerRequest(revokeTokensQueue, uid),
+			newWorkerRequest(deleteUserAppsQueue, uid),
+			newWorkerRequest(deleteUserCommentsQueue, uid),
+			newWorkerRequest(deleteUserPostsQueue, uid),
+		}, newWorkerRequest(deleteUserQueue, uid))
+		if err != nil {
+			handleRPCError(w, r, err)
+			return
+		}
+
+		acceptCascade(w, r, c)
+	}
+}
+
 func (s *Server) createUser() http.HandlerFunc {
 	type request struct {
 		Username string
@@ -56,13 +90,13 @@ func (s *Server) createUser() http.HandlerFunc {
 		var req request
 		b, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		err = json.Unmarshal(b, &req)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			writeError(w, r, http.StatusUnprocessableEntity, err.Error())
 			return
 		}
 
@@ -71,14 +105,14 @@ func (s *Server) createUser() http.HandlerFunc {
 			&user.CreateUserRequest{Username: req.Username, Password: req.Password},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		resp := response{createUserResponse.Uid, createUserResponse.Username}
 		json, err := json.Marshal(resp)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -104,13 +138,13 @@ func (s *Server) getToken() http.HandlerFunc {
 		var req request
 		b, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		err = json.Unmarshal(b, &req)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			writeError(w, r, http.StatusUnprocessableEntity, err.Error())
 			return
 		}
 
@@ -119,7 +153,7 @@ func (s *Server) getToken() http.HandlerFunc {
 			&user.GetTokenRequest{Username: req.Username, Password: req.Password},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -132,7 +166,7 @@ func (s *Server) getToken() http.HandlerFunc {
 				&user.GetTokenRequest{Username: req.Username, Password: req.Password},
 			)
 			if err != nil {
-				handleRPCError(w, err)
+				handleRPCError(w, r, err)
 				return
 			}
 
@@ -141,7 +175,7 @@ func (s *Server) getToken() http.HandlerFunc {
 
 		json, err := json.Marshal(resp)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -164,13 +198,13 @@ func (s *Server) refreshToken() http.HandlerFunc {
 		var req request
 		b, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		err = json.Unmarshal(b, &req)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			writeError(w, r, http.StatusUnprocessableEntity, err.Error())
 			return
 		}
 
@@ -179,14 +213,21 @@ func (s *Server) refreshToken() http.HandlerFunc {
 			&user.RefreshAccessTokenRequest{RefreshToken: req.Token},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
+		// Clients rarely send the access token being replaced, so every
+		// cached token of its owner is dropped too
+		if token := getAuthorizationToken(r); token != "" {
+			s.tokens.remove(token)
+		}
+		s.forgetTokensOf(ctx, refreshTokenResponse.AccessToken)
+
 		resp := response{refreshTokenResponse.AccessToken, refreshTokenResponse.RefreshToken}
 		json, err := json.Marshal(resp)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -195,8 +236,7 @@ func (s *Server) refreshToken() http.HandlerFunc {
 	}
 }
 
-func (s *Server) getUIDByToken(token string) (string, error) {
-	ctx := context.Background()
+func (s *Server) getUIDByToken(ctx context.Context, token string) (string, error) {
 	uid, err := s.userClient.client.GetUserByAccessToken(ctx,
 		&user.GetUserByAccessTokenRequest{UserToken: token},
 	)
@@ -218,33 +258,18 @@ func (s *Server) createApp() http.HandlerFunc {
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		userToken := getAuthorizationToken(r)
-		if userToken == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
-		userUID, err := s.getUIDByToken(userToken)
-		if err != nil {
-			handleRPCError(w, err)
-			return
-		}
-
-		if userUID == "" {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
+		userUID := principalFrom(r.Context()).UID
 
 		var req request
 		b, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		err = json.Unmarshal(b, &req)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			writeError(w, r, http.StatusUnprocessableEntity, err.Error())
 			return
 		}
 
@@ -253,14 +278,14 @@ func (s *Server) createApp() http.HandlerFunc {
 			&user.CreateAppRequest{Name: req.Name, Owner: userUID},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		resp := response{createAppResponse.Id, createAppResponse.Secret}
 		json, err := json.Marshal(resp)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -284,14 +309,14 @@ func (s *Server) getAppInfo() http.HandlerFunc {
 			&user.GetAppInfoRequest{Id: uid},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		resp := response{getAppInfoResponse.Owner, getAppInfoResponse.Name}
 		json, err := json.Marshal(resp)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -315,13 +340,13 @@ func (s *Server) getOAuthCode() http.HandlerFunc {
 		var req request
 		b, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		err = json.Unmarshal(b, &req)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			writeError(w, r, http.StatusUnprocessableEntity, err.Error())
 			return
 		}
 
@@ -330,14 +355,14 @@ func (s *Server) getOAuthCode() http.HandlerFunc {
 			&user.GetOAuthCodeRequest{Username: req.Username, Password: req.Password, AppUid: req.AppUID},
 		)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
 		resp := response{oauthCodeResponse.Code}
 		json, err := json.Marshal(resp)
 		if err != nil {
-			handleRPCError(w, err)
+			handleRPCError(w, r, err)
 			return
 		}
 
@@ -346,38 +371,20 @@ func (s *Server) getOAuthCode() http.HandlerFunc {
 	}
 }
 
-func (s *Server) getTokenFromOAuthCode() http.HandlerFunc {
-	type response struct {
-		AccessToken  string
-		RefreshToken string
-	}
-
-	return func(w http.ResponseWriter, r *http.Request) {
-		queryParams := r.URL.Query()
-		if queryParams.Get("grant_type") != "authorization_code" {
-			w.WriteHeader(http.StatusNotAcceptable)
-			return
-		}
-		code := queryParams.Get("code")
-		appID := queryParams.Get("client_id")
-		appSecret := queryParams.Get("client_secret")
-		ctx := r.Context()
-		getTokenResponse, err := s.userClient.client.GetTokenFromCode(ctx,
-			&user.GetTokenFromCodeRequest{Code: code, AppUid: appID, AppSecret: appSecret},
+// listUserAppIDs returns IDs of all OAuth apps owned by user userUID
+func listUserAppIDs(ctx context.Context, uc user.UserClient, userUID string) ([]string, error) {
+	return listPages(func(page int32) ([]string, error) {
+		appsResponse, err := uc.ListAppsByOwner(ctx,
+			&user.ListAppsByOwnerRequest{Owner: userUID, PageSize: cascadePageSize, PageNumber: page},
 		)
 		if err != nil {
-			handleRPCError(w, err)
-			return
+			return nil, err
 		}
 
-		resp := response{getTokenResponse.AccessToken, getTokenResponse.RefreshToken}
-		json, err := json.Marshal(resp)
-		if err != nil {
-			handleRPCError(w, err)
-			return
+		ids := make([]string, len(appsResponse.Apps))
+		for i, app := range appsResponse.Apps {
+			ids[i] = app.Id
 		}
-
-		w.WriteHeader(http.StatusOK)
-		w.Write(json)
-	}
+		return ids, nil
+	})
 }
@@ -2,92 +2,595 @@ package api
 
 import (
 	"context"
-	"log"
+	"math/rand"
 	"time"
 
+	category "github.com/andreymgn/RSOI-category/pkg/category/proto"
 	comment "github.com/andreymgn/RSOI-comment/pkg/comment/proto"
 	post "github.com/andreymgn/RSOI-post/pkg/post/proto"
 	poststats "github.com/andreymgn/RSOI-poststats/pkg/poststats/proto"
+	user "github.com/andreymgn/RSOI-user/pkg/user/proto"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+const (
+	deletePostQueue      = "post"
+	deletePostStatsQueue = "poststats"
+	deleteCommentQueue   = "comment"
+	deleteCategoryQueue  = "category"
+	deleteReportQueue    = "report"
+	deleteUserQueue      = "user"
+	deleteAppQueue       = "app"
+	revokeTokensQueue    = "user-tokens"
+	removeContentQueue   = "comment-content"
+	anonymizePostQueue   = "post-anonymize"
+
+	// deletePostCommentsQueue collects every comment of a post and enqueues
+	// their deletion
+	deletePostCommentsQueue = "post-comments"
+	// deleteCategoryPostsQueue collects every post of a category and enqueues
+	// their cascade deletion
+	deleteCategoryPostsQueue = "category-posts"
+	// deleteCategoryReportsQueue collects every report of a category and
+	// enqueues their deletion
+	deleteCategoryReportsQueue = "category-reports"
+	// deleteUserCommentsQueue collects every comment of a user and enqueues
+	// removal of their content
+	deleteUserCommentsQueue = "user-comments"
+	// deleteUserPostsQueue collects every post of a user and enqueues their
+	// deletion or anonymisation according to WorkerConfig.AccountPostPolicy
+	deleteUserPostsQueue = "user-posts"
+	// deleteUserAppsQueue collects every OAuth app of a user and enqueues
+	// their deletion
+	deleteUserAppsQueue = "user-apps"
+
+	jobStateWaiting   = "waiting"
+	jobStateQueued    = "queued"
+	jobStateInFlight  = "inflight"
+	jobStateDead      = "dead"
+	jobStateSucceeded = "succeeded"
+	jobStateDiscarded = "discarded"
+)
+
+var queueNames = []string{
+	deletePostQueue,
+	deletePostStatsQueue,
+	deleteCommentQueue,
+	deleteCategoryQueue,
+	deleteReportQueue,
+	deleteUserQueue,
+	deleteAppQueue,
+	revokeTokensQueue,
+	removeContentQueue,
+	anonymizePostQueue,
+	deletePostCommentsQueue,
+	deleteCategoryPostsQueue,
+	deleteCategoryReportsQueue,
+	deleteUserCommentsQueue,
+	deleteUserPostsQueue,
+	deleteUserAppsQueue,
+}
+
+// AccountPostPolicy defines what happens to posts of a deleted account
+type AccountPostPolicy string
+
+const (
+	// DeletePosts deletes posts together with their stats and comments
+	DeletePosts AccountPostPolicy = "delete"
+	// AnonymizePosts keeps posts but detaches them from the account
+	AnonymizePosts AccountPostPolicy = "anonymize"
+)
+
+// WorkerConfig controls background job processing
+type WorkerConfig struct {
+	// OutboxPath is the file where pending jobs and dead letters are kept
+	OutboxPath string
+	// MaxAttempts is the number of attempts after which a job is dead-lettered
+	MaxAttempts int
+	// BaseBackoff is the delay before the first retry, it doubles with every
+	// subsequent attempt
+	BaseBackoff time.Duration
+	// MaxBackoff caps the delay between attempts
+	MaxBackoff time.Duration
+	// AccountPostPolicy defines what happens to posts of a deleted account
+	AccountPostPolicy AccountPostPolicy
+	// ReconcileInterval is the period of the reconciler, zero disables it
+	ReconcileInterval time.Duration
+	// ReconcileRepair makes the periodic reconciler repair what it finds
+	ReconcileRepair bool
+	// Workers is the number of workers per queue
+	Workers int
+	// QueueWorkers overrides Workers for individual queues
+	QueueWorkers map[string]int
+	// DrainTimeout is how long in-flight jobs may run after shutdown begins,
+	// jobs still running after it are aborted and retried after restart
+	DrainTimeout time.Duration
+}
+
+// DefaultWorkerConfig returns WorkerConfig with sensible defaults
+func DefaultWorkerConfig() WorkerConfig {
+	return WorkerConfig{
+		OutboxPath:  "/outbox.log",
+		MaxAttempts: 10,
+		BaseBackoff: time.Second,
+		MaxBackoff:  time.Minute * 5,
+
+		AccountPostPolicy: DeletePosts,
+		ReconcileInterval: time.Hour,
+		Workers:           1,
+		DrainTimeout:      time.Second * 15,
+	}
+}
+
 type workerRequest struct {
-	uid      string
-	doneTime time.Time
+	id        string
+	queue     string
+	uid       string
+	cascadeID string
+	// requestID is ID of the HTTP request which started the job, or the job
+	// which enqueued it
+	requestID string
+	attempts  int
+	lastError string
+	doneTime  time.Time
 }
 
-func (s *Server) deletePostWorker() {
-	ctx := context.Background()
-	for {
-		req := <-s.deletePostChannel
+func newWorkerRequest(queue, uid string) workerRequest {
+	return workerRequest{id: uuid.New().String(), queue: queue, uid: uid, doneTime: time.Now()}
+}
 
-		if time.Now().Before(req.doneTime) {
-			s.deletePostChannel <- req
-			continue
+// jobHandler carries out a single job
+type jobHandler func(ctx context.Context, req workerRequest) error
+
+func (s *Server) jobHandlers() map[string]jobHandler {
+	return map[string]jobHandler{
+		deletePostQueue:            s.deletePostJob,
+		deletePostStatsQueue:       s.deletePostStatsJob,
+		deleteCommentQueue:         s.deleteCommentJob,
+		deletePostCommentsQueue:    s.deletePostCommentsJob,
+		deleteCategoryQueue:        s.deleteCategoryJob,
+		deleteReportQueue:          s.deleteReportJob,
+		deleteCategoryPostsQueue:   s.deleteCategoryPostsJob,
+		deleteCategoryReportsQueue: s.deleteCategoryReportsJob,
+		deleteUserQueue:            s.deleteUserJob,
+		deleteAppQueue:             s.deleteAppJob,
+		revokeTokensQueue:          s.revokeTokensJob,
+		removeContentQueue:         s.removeContentJob,
+		anonymizePostQueue:         s.anonymizePostJob,
+		deleteUserCommentsQueue:    s.deleteUserCommentsJob,
+		deleteUserPostsQueue:       s.deleteUserPostsJob,
+		deleteUserAppsQueue:        s.deleteUserAppsJob,
+	}
+}
+
+// startWorkers starts the configured number of workers for every queue. Workers
+// stop taking jobs once ctx is done, jobCtx is passed to the jobs themselves.
+func (s *Server) startWorkers(ctx, jobCtx context.Context) {
+	for queue, handle := range s.jobHandlers() {
+		n := s.workerConfig.Workers
+		if qn, ok := s.workerConfig.QueueWorkers[queue]; ok {
+			n = qn
 		}
 
-		_, err := s.postClient.client.DeletePost(ctx,
-			&post.DeletePostRequest{Uid: req.uid},
-		)
-		if err != nil {
-			if st, ok := status.FromError(err); ok {
-				if st.Code() == codes.Unavailable {
-					newReq := workerRequest{req.uid, time.Now().Add(time.Second * 5)}
-					s.deletePostChannel <- newReq
-					log.Printf("DeletePost rabotyaga: retrying %s", req.uid)
-				}
+		for i := 0; i < n; i++ {
+			s.workers.Add(1)
+			go func(queue string, handle jobHandler) {
+				defer s.workers.Done()
+				s.work(ctx, jobCtx, queue, handle)
+			}(queue, handle)
+		}
+	}
+}
+
+// enqueue writes jobs to the outbox and hands them to the workers. Once it
+// returns without error the jobs will be executed even if the server restarts.
+// Jobs carry ID of the request ctx belongs to.
+func (s *Server) enqueue(ctx context.Context, reqs ...workerRequest) error {
+	setRequestID(ctx, reqs)
+	if err := s.outbox.add(reqs...); err != nil {
+		return err
+	}
+
+	for _, req := range reqs {
+		s.queues[req.queue].push(req)
+	}
+
+	return nil
+}
+
+// setRequestID makes reqs carry ID of the request ctx belongs to
+func setRequestID(ctx context.Context, reqs []workerRequest) {
+	id := requestIDFrom(ctx)
+	for i := range reqs {
+		if reqs[i].requestID == "" {
+			reqs[i].requestID = id
+		}
+	}
+}
+
+// replayOutbox hands jobs left unfinished by the previous run to the workers
+func (s *Server) replayOutbox() {
+	pending := s.outbox.pending()
+	if len(pending) > 0 {
+		log.WithField("jobs", len(pending)).Info("replaying pending jobs")
+	}
+
+	for _, req := range pending {
+		q, ok := s.queues[req.queue]
+		if !ok {
+			jobLogger(req).Warn("dropping job with unknown queue")
+			if err := s.finishJob(req.id, jobStateDiscarded); err != nil {
+				jobLogger(req).WithError(err).Error("outbox: can't discard job")
 			}
+			continue
 		}
+
+		req.doneTime = time.Now()
+		q.push(req)
+	}
+}
+
+// jobLogger returns logger which describes job req on every line
+func jobLogger(req workerRequest) *log.Entry {
+	return log.WithFields(log.Fields{
+		"job_id":     req.id,
+		"queue":      req.queue,
+		"uid":        req.uid,
+		"cascade_id": req.cascadeID,
+		"request_id": req.requestID,
+		"attempts":   req.attempts,
+	})
+}
+
+// finishJob removes finished job from the outbox and hands the jobs its
+// cascade held until then to the workers
+func (s *Server) finishJob(id, result string) error {
+	released, err := s.outbox.done(id, result)
+	for _, r := range released {
+		if q, ok := s.queues[r.queue]; ok {
+			q.push(r)
+		}
+	}
+
+	return err
+}
+
+// backoff returns delay before the next attempt of a job which has already
+// been tried attempts times
+func (s *Server) backoff(attempts int) time.Duration {
+	return jitteredBackoff(s.workerConfig.BaseBackoff, s.workerConfig.MaxBackoff, attempts)
+}
+
+// jitteredBackoff returns delay before the next attempt of an operation which
+// has already been tried attempts times. The delay grows exponentially from
+// base up to max and is randomized between a half and a full step so that
+// retries of many operations don't align.
+func jitteredBackoff(base, max time.Duration, attempts int) time.Duration {
+	d := base
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+
+	if d > max {
+		d = max
 	}
+
+	half := int64(d / 2)
+	if half <= 0 {
+		return d
+	}
+
+	return time.Duration(half + rand.Int63n(half+1))
 }
 
-func (s *Server) deletePostStatsWorker() {
-	ctx := context.Background()
+// isRetryable reports whether a failed job should be tried again
+func isRetryable(err error) bool {
+	st, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+
+	switch st.Code() {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+// work processes jobs from queue with handle until ctx is done. A job
+// interrupted by cancellation of jobCtx stays in the outbox and is run again
+// after restart.
+func (s *Server) work(ctx, jobCtx context.Context, queue string, handle jobHandler) {
+	q := s.queues[queue]
 	for {
-		req := <-s.deletePostStatsChannel
+		req, ok := q.pop(ctx)
+		if !ok {
+			return
+		}
+
+		requestID := req.requestID
+		if requestID == "" {
+			requestID = req.id
+		}
+
+		err := handle(withRequestID(jobCtx, requestID), req)
+		if err != nil && jobCtx.Err() != nil {
+			q.release(req.id)
+			jobLogger(req).Warn("job interrupted by shutdown")
+			return
+		}
 
-		if time.Now().Before(req.doneTime) {
-			s.deletePostStatsChannel <- req
+		if err == nil || status.Code(err) == codes.NotFound {
+			if err := s.finishJob(req.id, jobStateSucceeded); err != nil {
+				jobLogger(req).WithError(err).Error("outbox: can't mark job as done")
+			}
+			q.release(req.id)
+			s.metrics.jobsFinished.WithLabelValues(queue, jobStateSucceeded).Inc()
 			continue
 		}
 
-		_, err := s.postStatsClient.client.DeletePostStats(ctx,
-			&poststats.DeletePostStatsRequest{PostUid: req.uid},
-		)
-		if err != nil {
-			if st, ok := status.FromError(err); ok {
-				if st.Code() == codes.Unavailable {
-					newReq := workerRequest{req.uid, time.Now().Add(time.Second * 5)}
-					s.deletePostStatsChannel <- newReq
-					log.Printf("DeletePostStats rabotyaga: retrying %s", req.uid)
-				}
+		req.attempts++
+		req.lastError = err.Error()
+
+		if isRetryable(err) && req.attempts < s.workerConfig.MaxAttempts {
+			if err := s.outbox.retry(req); err != nil {
+				jobLogger(req).WithError(err).Error("outbox: can't record attempt of job")
 			}
+
+			delay := s.backoff(req.attempts)
+			req.doneTime = time.Now().Add(delay)
+			q.requeue(req)
+			s.metrics.jobRetries.WithLabelValues(queue).Inc()
+			jobLogger(req).WithError(err).WithField("delay", delay.String()).Warn("retrying job")
+			continue
+		}
+
+		if err := s.outbox.bury(req); err != nil {
+			jobLogger(req).WithError(err).Error("outbox: can't dead-letter job")
 		}
+		q.release(req.id)
+		s.metrics.jobsFinished.WithLabelValues(queue, jobStateDead).Inc()
+		jobLogger(req).WithError(err).Error("giving up on job")
 	}
 }
 
-func (s *Server) deleteCommentWorker() {
-	ctx := context.Background()
-	for {
-		req := <-s.deleteCommentChannel
+func (s *Server) deletePostJob(ctx context.Context, req workerRequest) error {
+	_, err := s.postClient.client.DeletePost(ctx,
+		&post.DeletePostRequest{Uid: req.uid},
+	)
+	return err
+}
+
+func (s *Server) deletePostStatsJob(ctx context.Context, req workerRequest) error {
+	_, err := s.postStatsClient.client.DeletePostStats(ctx,
+		&poststats.DeletePostStatsRequest{PostUid: req.uid},
+	)
+	return err
+}
 
-		if time.Now().Before(req.doneTime) {
-			s.deleteCommentChannel <- req
+func (s *Server) deleteCommentJob(ctx context.Context, req workerRequest) error {
+	_, err := s.commentClient.client.DeleteComment(ctx,
+		&comment.DeleteCommentRequest{Uid: req.uid},
+	)
+	return err
+}
+
+func (s *Server) deletePostCommentsJob(ctx context.Context, req workerRequest) error {
+	uids, err := listCommentUIDs(ctx, s.commentClient.client, req.uid)
+	if err != nil {
+		return err
+	}
+
+	if len(uids) == 0 {
+		return nil
+	}
+
+	jobs := make([]workerRequest, len(uids))
+	for i, uid := range uids {
+		jobs[i] = newWorkerRequest(deleteCommentQueue, uid)
+		jobs[i].cascadeID = req.cascadeID
+	}
+
+	return s.enqueue(ctx, jobs...)
+}
+
+// deleteCategoryJob deletes the category once it has no posts. Posts created
+// after its posts were listed are deleted first and the job is retried.
+func (s *Server) deleteCategoryJob(ctx context.Context, req workerRequest) error {
+	uids, err := listCategoryPostUIDs(ctx, s.postClient.client, req.uid)
+	if err != nil {
+		return err
+	}
+
+	if len(uids) > 0 {
+		if err := s.enqueuePostDeletion(ctx, req, uids); err != nil {
+			return err
+		}
+		return status.Errorf(codes.Aborted, "category still has %d posts", len(uids))
+	}
+
+	_, err = s.categoryClient.client.DeleteCategory(ctx,
+		&category.DeleteCategoryRequest{Uid: req.uid},
+	)
+	return err
+}
+
+func (s *Server) deleteReportJob(ctx context.Context, req workerRequest) error {
+	_, err := s.categoryClient.client.DeleteReport(ctx,
+		&category.DeleteReportRequest{Uid: req.uid},
+	)
+	return err
+}
+
+func (s *Server) deleteCategoryPostsJob(ctx context.Context, req workerRequest) error {
+	uids, err := listCategoryPostUIDs(ctx, s.postClient.client, req.uid)
+	if err != nil {
+		return err
+	}
+
+	return s.enqueuePostDeletion(ctx, req, uids)
+}
+
+// enqueuePostDeletion enqueues deletion of posts uids and everything attached
+// to them as part of the cascade of req. Posts already being deleted are
+// skipped.
+func (s *Server) enqueuePostDeletion(ctx context.Context, req workerRequest, uids []string) error {
+	pending := s.outbox.pendingUIDs(deletePostQueue)
+	jobs := make([]workerRequest, 0, len(uids)*3)
+	for _, uid := range uids {
+		if pending[uid] {
 			continue
 		}
 
-		_, err := s.commentClient.client.DeleteComment(ctx,
-			&comment.DeleteCommentRequest{Uid: req.uid},
+		jobs = append(jobs,
+			newWorkerRequest(deletePostQueue, uid),
+			newWorkerRequest(deletePostStatsQueue, uid),
+			newWorkerRequest(deletePostCommentsQueue, uid),
 		)
-		if err != nil {
-			if st, ok := status.FromError(err); ok {
-				if st.Code() == codes.Unavailable {
-					newReq := workerRequest{req.uid, time.Now().Add(time.Second * 5)}
-					s.deleteCommentChannel <- newReq
-					log.Printf("DeleteComment rabotyaga: retrying %s", req.uid)
-				}
-			}
+	}
+
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	for i := range jobs {
+		jobs[i].cascadeID = req.cascadeID
+	}
+
+	return s.enqueue(ctx, jobs...)
+}
+
+func (s *Server) deleteCategoryReportsJob(ctx context.Context, req workerRequest) error {
+	uids, err := listReportUIDs(ctx, s.categoryClient.client, req.uid)
+	if err != nil {
+		return err
+	}
+
+	if len(uids) == 0 {
+		return nil
+	}
+
+	jobs := make([]workerRequest, len(uids))
+	for i, uid := range uids {
+		jobs[i] = newWorkerRequest(deleteReportQueue, uid)
+		jobs[i].cascadeID = req.cascadeID
+	}
+
+	return s.enqueue(ctx, jobs...)
+}
+
+func (s *Server) deleteUserJob(ctx context.Context, req workerRequest) error {
+	_, err := s.userClient.client.DeleteUser(ctx,
+		&user.DeleteUserRequest{Uid: req.uid},
+	)
+	return err
+}
+
+func (s *Server) deleteAppJob(ctx context.Context, req workerRequest) error {
+	_, err := s.userClient.client.DeleteApp(ctx,
+		&user.DeleteAppRequest{Id: req.uid},
+	)
+	return err
+}
+
+func (s *Server) revokeTokensJob(ctx context.Context, req workerRequest) error {
+	_, err := s.userClient.client.RevokeUserTokens(ctx,
+		&user.RevokeUserTokensRequest{Uid: req.uid},
+	)
+	if err != nil {
+		return err
+	}
+
+	s.tokens.removeUID(req.uid)
+	if s.verifier != nil {
+		s.verifier.revoke(req.uid)
+	}
+	return nil
+}
+
+func (s *Server) removeContentJob(ctx context.Context, req workerRequest) error {
+	_, err := s.commentClient.client.RemoveContent(ctx,
+		&comment.RemoveContentRequest{Uid: req.uid},
+	)
+	return err
+}
+
+func (s *Server) anonymizePostJob(ctx context.Context, req workerRequest) error {
+	_, err := s.postClient.client.AnonymizePost(ctx,
+		&post.AnonymizePostRequest{Uid: req.uid},
+	)
+	return err
+}
+
+func (s *Server) deleteUserCommentsJob(ctx context.Context, req workerRequest) error {
+	uids, err := listUserCommentUIDs(ctx, s.commentClient.client, req.uid)
+	if err != nil {
+		return err
+	}
+
+	if len(uids) == 0 {
+		return nil
+	}
+
+	jobs := make([]workerRequest, len(uids))
+	for i, uid := range uids {
+		jobs[i] = newWorkerRequest(removeContentQueue, uid)
+		jobs[i].cascadeID = req.cascadeID
+	}
+
+	return s.enqueue(ctx, jobs...)
+}
+
+func (s *Server) deleteUserPostsJob(ctx context.Context, req workerRequest) error {
+	uids, err := listUserPostUIDs(ctx, s.postClient.client, req.uid)
+	if err != nil {
+		return err
+	}
+
+	if len(uids) == 0 {
+		return nil
+	}
+
+	jobs := make([]workerRequest, 0, len(uids)*3)
+	for _, uid := range uids {
+		if s.workerConfig.AccountPostPolicy == AnonymizePosts {
+			jobs = append(jobs, newWorkerRequest(anonymizePostQueue, uid))
+			continue
 		}
+
+		jobs = append(jobs,
+			newWorkerRequest(deletePostQueue, uid),
+			newWorkerRequest(deletePostStatsQueue, uid),
+			newWorkerRequest(deletePostCommentsQueue, uid),
+		)
+	}
+
+	for i := range jobs {
+		jobs[i].cascadeID = req.cascadeID
 	}
+
+	return s.enqueue(ctx, jobs...)
+}
+
+func (s *Server) deleteUserAppsJob(ctx context.Context, req workerRequest) error {
+	ids, err := listUserAppIDs(ctx, s.userClient.client, req.uid)
+	if err != nil {
+		return err
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	jobs := make([]workerRequest, len(ids))
+	for i, id := range ids {
+		jobs[i] = newWorkerRequest(deleteAppQueue, id)
+		jobs[i].cascadeID = req.cascadeID
+	}
+
+	return s.enqueue(ctx, jobs...)
 }
@@ -0,0 +1,276 @@
+// Package config loads configuration of the API gateway. Settings are taken,
+// in order of increasing precedence, from defaults, a YAML or TOML file, RSOI_*
+// environment variables and command line flags.
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	api "github.com/andreymgn/RSOI-api/pkg/api"
+	"github.com/sirupsen/logrus"
+)
+
+// TLS controls the connection to a backend
+type TLS struct {
+	// Disabled makes the gateway connect to the backend in plaintext
+	Disabled bool
+	// CAFile is the PEM bundle used to verify the backend's certificate
+	CAFile string
+	// CertFile and KeyFile hold the client certificate the gateway presents
+	// to the backend
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name the backend's certificate is checked
+	// against
+	ServerName string
+}
+
+// Backend is a gRPC service the gateway talks to
+type Backend struct {
+	Addr string
+	TLS  TLS
+	// Optional backends don't make the gateway unready when they are down
+	Optional bool
+	// HealthCheck makes the readiness probe call the gRPC health checking
+	// service of the backend
+	HealthCheck bool
+}
+
+// Log controls logging
+type Log struct {
+	// Level is one of debug, info, warning, error
+	Level string
+	// Format is json or text
+	Format string
+}
+
+// OAuthCORS overrides CORS policy of the OAuth endpoints, which third-party
+// applications call from origins the rest of the API doesn't trust
+type OAuthCORS struct {
+	// AllowedOrigins replaces the origins of the main policy. The main
+	// policy applies when neither field is set.
+	AllowedOrigins   []string
+	AllowCredentials bool
+}
+
+// Config is the complete configuration of the gateway
+type Config struct {
+	HTTP    api.HTTPConfig
+	Workers api.WorkerConfig
+	Breaker api.BreakerConfig
+	RPC     api.RPCConfig
+	Log     Log
+	// OAuthCORS is applied to /api/oauth/ as an override of HTTP.CORS
+	OAuthCORS OAuthCORS
+
+	Post      Backend
+	Category  Backend
+	Comment   Backend
+	PostStats Backend
+	User      Backend
+
+	JaegerAddr string
+}
+
+// Default returns configuration used when nothing is overridden
+func Default() Config {
+	return Config{
+		HTTP:    api.DefaultHTTPConfig(),
+		Workers: api.DefaultWorkerConfig(),
+		Breaker: api.DefaultBreakerConfig(),
+		RPC:     api.DefaultRPCConfig(),
+		Log:     Log{Level: "info", Format: "json"},
+
+		Post:      Backend{TLS: TLS{CAFile: "/post-cert.pem"}},
+		Category:  Backend{TLS: TLS{CAFile: "/category-cert.pem"}},
+		Comment:   Backend{TLS: TLS{CAFile: "/comment-cert.pem"}},
+		PostStats: Backend{TLS: TLS{CAFile: "/poststats-cert.pem"}},
+		User:      Backend{TLS: TLS{CAFile: "/user-cert.pem"}},
+	}
+}
+
+// oauthPrefix is the path prefix of the OAuth endpoints
+const oauthPrefix = "/api/oauth/"
+
+// corsOverrides returns per-route CORS policies derived from c
+func (c *Config) corsOverrides() map[string]api.CORSConfig {
+	if len(c.OAuthCORS.AllowedOrigins) == 0 && !c.OAuthCORS.AllowCredentials {
+		return nil
+	}
+
+	oauth := c.HTTP.CORS
+	oauth.AllowedOrigins = c.OAuthCORS.AllowedOrigins
+	oauth.AllowCredentials = c.OAuthCORS.AllowCredentials
+	return map[string]api.CORSConfig{oauthPrefix: oauth}
+}
+
+// Backends returns backends by name
+func (c *Config) Backends() map[string]*Backend {
+	return map[string]*Backend{
+		"post":      &c.Post,
+		"category":  &c.Category,
+		"comment":   &c.Comment,
+		"poststats": &c.PostStats,
+		"user":      &c.User,
+	}
+}
+
+// ValidationError lists every problem found in a configuration
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// Validate checks that configuration is complete and consistent
+func (c *Config) Validate() error {
+	var errs ValidationError
+	check := func(ok bool, setting, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, setting+": "+fmt.Sprintf(format, args...))
+		}
+	}
+
+	_, _, err := net.SplitHostPort(c.HTTP.Addr)
+	check(err == nil, "listen", "%q is not a valid address", c.HTTP.Addr)
+	if c.HTTP.MetricsAddr != "" {
+		_, _, err := net.SplitHostPort(c.HTTP.MetricsAddr)
+		check(err == nil, "metrics-listen", "%q is not a valid address", c.HTTP.MetricsAddr)
+		check(c.HTTP.MetricsAddr != c.HTTP.Addr, "metrics-listen", "must differ from -listen")
+	}
+	check(c.HTTP.ReadTimeout >= 0, "http-read-timeout", "must not be negative")
+	check(c.HTTP.WriteTimeout >= 0, "http-write-timeout", "must not be negative")
+	check(c.HTTP.IdleTimeout >= 0, "http-idle-timeout", "must not be negative")
+	check(c.HTTP.ShutdownTimeout > 0, "http-shutdown-timeout", "must be positive")
+	check(c.HTTP.ReadinessTimeout > 0, "readiness-timeout", "must be positive")
+	check(c.HTTP.RouteTimeout >= 0, "route-timeout", "must not be negative")
+	for route, t := range c.HTTP.RouteTimeouts {
+		check(t >= 0, "route-timeouts", "timeout of %q must not be negative", route)
+	}
+	checkCORS(check, "cors", c.HTTP.CORS)
+	check(c.HTTP.CORS.MaxAge >= 0, "cors-max-age", "must not be negative")
+	if oauth, ok := c.corsOverrides()[oauthPrefix]; ok {
+		checkCORS(check, "cors-oauth", oauth)
+	}
+
+	for _, cidr := range c.HTTP.RateLimit.TrustedProxies {
+		_, _, err := net.ParseCIDR(cidr)
+		check(err == nil, "ratelimit-trusted-proxies", "%q is not a CIDR", cidr)
+	}
+	h := c.HTTP.RateLimit.ClientIPHeader
+	check(h == "" || http.CanonicalHeaderKey(h) == "X-Forwarded-For" || http.CanonicalHeaderKey(h) == "X-Real-Ip",
+		"ratelimit-client-ip-header", "must be X-Forwarded-For or X-Real-IP")
+
+	check(c.HTTP.Auth.CacheSize >= 0, "auth-cache-size", "must not be negative")
+	check(c.HTTP.Auth.CacheTTL >= 0, "auth-cache-ttl", "must not be negative")
+	check(c.HTTP.Auth.PolicyCacheTTL >= 0, "auth-policy-cache-ttl", "must not be negative")
+	check(c.HTTP.Auth.AccessTokenTTL > 0, "auth-access-token-ttl", "must be positive")
+	jwt := c.HTTP.Auth.JWT
+	checkFile(check, "auth-jwt-keys-file", jwt.KeysFile)
+	if jwt.JWKSURL != "" {
+		u, err := url.Parse(jwt.JWKSURL)
+		check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "", "auth-jwt-jwks-url", "%q is not an HTTP(S) URL", jwt.JWKSURL)
+		check(jwt.JWKSRefresh > 0, "auth-jwt-jwks-refresh", "must be positive")
+	}
+	check(jwt.ClockSkew >= 0, "auth-jwt-clock-skew", "must not be negative")
+
+	t := c.HTTP.TLS
+	check(t.CertFile != "" || t.KeyFile == "", "tls-cert-file", "must be set together with tls-key-file")
+	check(t.KeyFile != "" || t.CertFile == "", "tls-key-file", "must be set together with tls-cert-file")
+	checkFile(check, "tls-cert-file", t.CertFile)
+	checkFile(check, "tls-key-file", t.KeyFile)
+	check(t.RedirectAddr == "" || t.Enabled(), "tls-redirect-addr", "requires tls-cert-file and tls-key-file")
+	_, err = api.ParseTLSVersion(t.MinVersion)
+	check(err == nil, "tls-min-version", "%v", err)
+	_, err = api.ParseCipherSuites(t.CipherSuites)
+	check(err == nil, "tls-cipher-suites", "%v", err)
+
+	w := c.Workers
+	check(w.OutboxPath != "", "workers-outbox-path", "must be set")
+	check(w.MaxAttempts > 0, "workers-max-attempts", "must be positive")
+	check(w.BaseBackoff > 0, "workers-base-backoff", "must be positive")
+	check(w.MaxBackoff >= w.BaseBackoff, "workers-max-backoff", "must not be less than workers-base-backoff")
+	check(w.AccountPostPolicy == api.DeletePosts || w.AccountPostPolicy == api.AnonymizePosts,
+		"workers-account-post-policy", "must be %q or %q", api.DeletePosts, api.AnonymizePosts)
+	check(w.ReconcileInterval >= 0, "workers-reconcile-interval", "must not be negative")
+	check(w.Workers > 0, "workers-per-queue", "must be positive")
+	for queue, n := range w.QueueWorkers {
+		check(n >= 0, "workers-queues", "queue %q has negative number of workers", queue)
+	}
+	check(w.DrainTimeout > 0, "workers-drain-timeout", "must be positive")
+
+	br := c.Breaker
+	check(br.FailureRate >= 0 && br.FailureRate <= 1, "breaker-failure-rate", "must be between 0 and 1")
+	if br.FailureRate > 0 {
+		check(br.MinRequests > 0, "breaker-min-requests", "must be positive")
+		check(br.Window > 0, "breaker-window", "must be positive")
+		check(br.OpenTimeout > 0, "breaker-open-timeout", "must be positive")
+		check(br.HalfOpenRequests > 0, "breaker-half-open-requests", "must be positive")
+	}
+
+	check(c.RPC.Timeout >= 0, "rpc-timeout", "must not be negative")
+	for method, t := range c.RPC.Timeouts {
+		check(t >= 0, "rpc-timeouts", "timeout of %q must not be negative", method)
+	}
+	check(c.RPC.RetryAttempts > 0, "rpc-retry-attempts", "must be positive")
+	if c.RPC.RetryAttempts > 1 {
+		check(c.RPC.RetryBaseBackoff > 0, "rpc-retry-base-backoff", "must be positive")
+		check(c.RPC.RetryMaxBackoff >= c.RPC.RetryBaseBackoff, "rpc-retry-max-backoff", "must not be less than rpc-retry-base-backoff")
+	}
+
+	_, err = logrus.ParseLevel(c.Log.Level)
+	check(err == nil, "log-level", "%q is not a valid level", c.Log.Level)
+	check(c.Log.Format == "json" || c.Log.Format == "text", "log-format", "must be json or text")
+
+	for _, name := range backendNames {
+		b := c.Backends()[name]
+		check(b.Addr != "", name+"-addr", "must be set")
+		if b.TLS.Disabled {
+			continue
+		}
+
+		check(b.TLS.CAFile != "", name+"-tls-ca-file", "must be set unless %s-tls-disabled is true", name)
+		checkFile(check, name+"-tls-ca-file", b.TLS.CAFile)
+		check(b.TLS.CertFile != "" || b.TLS.KeyFile == "", name+"-tls-cert-file", "must be set together with %s-tls-key-file", name)
+		check(b.TLS.KeyFile != "" || b.TLS.CertFile == "", name+"-tls-key-file", "must be set together with %s-tls-cert-file", name)
+		checkFile(check, name+"-tls-cert-file", b.TLS.CertFile)
+		checkFile(check, name+"-tls-key-file", b.TLS.KeyFile)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// checkCORS checks origins of policy p configured by flags starting with
+// prefix. No origins means no cross-origin access.
+func checkCORS(check func(bool, string, string, ...interface{}), prefix string, p api.CORSConfig) {
+	setting := prefix + "-allowed-origins"
+	for _, origin := range p.AllowedOrigins {
+		if origin == "*" {
+			check(!p.AllowCredentials, setting, "\"*\" can't be used together with %s-allow-credentials", prefix)
+			continue
+		}
+
+		check(strings.Count(origin, "*") <= 1, setting, "%q may contain only one wildcard", origin)
+		check(strings.Contains(origin, "://"), setting, "%q must include scheme, e.g. https://%s", origin, origin)
+	}
+}
+
+// checkFile reports setting if it names a file which can't be accessed
+func checkFile(check func(bool, string, string, ...interface{}), setting, path string) {
+	if path != "" {
+		_, err := os.Stat(path)
+		check(err == nil, setting, "%v", err)
+	}
+}
+
+// backendNames lists backends in a stable order
+var backendNames = []string{"post", "category", "comment", "poststats", "user"}
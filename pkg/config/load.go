@@ -0,0 +1,428 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	api "github.com/andreymgn/RSOI-api/pkg/api"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// envPrefix is prepended to the upper-cased flag name with dashes replaced by
+// underscores to get the name of the environment variable, e.g. flag
+// -post-tls-ca-file becomes RSOI_POST_TLS_CA_FILE
+const envPrefix = "RSOI_"
+
+// Load builds configuration from defaults, the file given by -config or
+// RSOI_CONFIG, the environment and command line args, later sources overriding
+// earlier ones, and validates it. It returns flag.ErrHelp if -help was
+// requested.
+func Load(name string, args []string) (Config, error) {
+	// Flags are parsed first because they name the file, but are applied last
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	path := fs.String("config", os.Getenv(envPrefix+"CONFIG"), "YAML or TOML configuration `file`")
+	scratch := Default()
+	scratch.bind(fs)
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	if fs.NArg() > 0 {
+		return Config{}, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	c := Default()
+	settings := flag.NewFlagSet(name, flag.ContinueOnError)
+	c.bind(settings)
+
+	if *path != "" {
+		if err := loadFile(settings, *path); err != nil {
+			return Config{}, fmt.Errorf("%s: %v", *path, err)
+		}
+	}
+
+	if err := loadEnv(settings); err != nil {
+		return Config{}, err
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "config" || err != nil {
+			return
+		}
+
+		if setErr := settings.Set(f.Name, f.Value.String()); setErr != nil {
+			err = fmt.Errorf("-%s: %v", f.Name, setErr)
+		}
+	})
+	if err != nil {
+		return Config{}, err
+	}
+
+	c.HTTP.CORSOverrides = c.corsOverrides()
+	return c, c.Validate()
+}
+
+// bind registers every setting of c as a flag of fs
+func (c *Config) bind(fs *flag.FlagSet) {
+	fs.StringVar(&c.HTTP.Addr, "listen", c.HTTP.Addr, "`address` the HTTP server listens on")
+	fs.StringVar(&c.HTTP.MetricsAddr, "metrics-listen", c.HTTP.MetricsAddr, "`address` serving /metrics apart from the API, empty disables it")
+	fs.DurationVar(&c.HTTP.ReadTimeout, "http-read-timeout", c.HTTP.ReadTimeout, "maximum duration for reading a request")
+	fs.DurationVar(&c.HTTP.WriteTimeout, "http-write-timeout", c.HTTP.WriteTimeout, "maximum duration for writing a response")
+	fs.DurationVar(&c.HTTP.IdleTimeout, "http-idle-timeout", c.HTTP.IdleTimeout, "how long an idle keep-alive connection is kept open")
+	fs.DurationVar(&c.HTTP.ShutdownTimeout, "http-shutdown-timeout", c.HTTP.ShutdownTimeout, "how long in-flight requests may take after shutdown begins")
+	fs.DurationVar(&c.HTTP.RouteTimeout, "route-timeout", c.HTTP.RouteTimeout, "deadline of backend calls made for a request, 0 disables it")
+	fs.Var((*durationMapValue)(&c.HTTP.RouteTimeouts), "route-timeouts", "comma-separated `route=timeout` overrides of -route-timeout, e.g. GET /api/posts=2s")
+	fs.DurationVar(&c.HTTP.ReadinessTimeout, "readiness-timeout", c.HTTP.ReadinessTimeout, "timeout of backend health checks made by /readyz")
+
+	fs.Var((*listValue)(&c.HTTP.CORS.AllowedOrigins), "cors-allowed-origins", "comma-separated `list` of allowed origins, none if empty")
+	fs.Var((*listValue)(&c.HTTP.CORS.AllowedMethods), "cors-allowed-methods", "comma-separated `list` of allowed methods")
+	fs.Var((*listValue)(&c.HTTP.CORS.AllowedHeaders), "cors-allowed-headers", "comma-separated `list` of allowed request headers")
+	fs.BoolVar(&c.HTTP.CORS.AllowCredentials, "cors-allow-credentials", c.HTTP.CORS.AllowCredentials, "allow credentials in cross-origin requests")
+	fs.Var((*listValue)(&c.HTTP.CORS.ExposedHeaders), "cors-exposed-headers", "comma-separated `list` of response headers readable by scripts")
+	fs.DurationVar(&c.HTTP.CORS.MaxAge, "cors-max-age", c.HTTP.CORS.MaxAge, "how long browsers may cache preflight responses")
+	fs.Var((*listValue)(&c.OAuthCORS.AllowedOrigins), "cors-oauth-allowed-origins", "comma-separated `list` of origins allowed to call /api/oauth/, overrides -cors-allowed-origins there")
+	fs.BoolVar(&c.OAuthCORS.AllowCredentials, "cors-oauth-allow-credentials", c.OAuthCORS.AllowCredentials, "allow credentials in cross-origin requests to /api/oauth/")
+
+	fs.Var((*rateLimitValue)(&c.HTTP.RateLimit.Default), "ratelimit-default", "`policy` of routes without their own, key:limit/period[:burst] where key is ip, user or app, e.g. ip:20/1s:40")
+	fs.Var((*rateLimitMapValue)(&c.HTTP.RateLimit.Routes), "ratelimit-routes", "comma-separated `route=policy` pairs, route may end with * to cover a group, e.g. POST /api/auth/token=ip:10/1m")
+	fs.Var((*listValue)(&c.HTTP.RateLimit.TrustedProxies), "ratelimit-trusted-proxies", "comma-separated `list` of CIDRs of proxies whose client IP header is trusted")
+	fs.StringVar(&c.HTTP.RateLimit.ClientIPHeader, "ratelimit-client-ip-header", c.HTTP.RateLimit.ClientIPHeader, "`header` carrying client IP set by trusted proxies: X-Forwarded-For or X-Real-IP")
+
+	fs.IntVar(&c.HTTP.Auth.CacheSize, "auth-cache-size", c.HTTP.Auth.CacheSize, "maximum number of cached access tokens, 0 disables the cache")
+	fs.DurationVar(&c.HTTP.Auth.CacheTTL, "auth-cache-ttl", c.HTTP.Auth.CacheTTL, "how long a cached access token is trusted without asking the user service")
+	fs.DurationVar(&c.HTTP.Auth.PolicyCacheTTL, "auth-policy-cache-ttl", c.HTTP.Auth.PolicyCacheTTL, "how long owners of posts, comments and categories are cached for authorization")
+	fs.DurationVar(&c.HTTP.Auth.AccessTokenTTL, "auth-access-token-ttl", c.HTTP.Auth.AccessTokenTTL, "lifetime of opaque access tokens reported as expires_in by /api/oauth/token")
+	fs.StringVar(&c.HTTP.Auth.JWT.KeysFile, "auth-jwt-keys-file", c.HTTP.Auth.JWT.KeysFile, "JWKS or PEM `file` with public keys verifying signed access tokens")
+	fs.StringVar(&c.HTTP.Auth.JWT.JWKSURL, "auth-jwt-jwks-url", c.HTTP.Auth.JWT.JWKSURL, "`URL` of JWKS document with public keys verifying signed access tokens")
+	fs.DurationVar(&c.HTTP.Auth.JWT.JWKSRefresh, "auth-jwt-jwks-refresh", c.HTTP.Auth.JWT.JWKSRefresh, "how often the JWKS document is fetched")
+	fs.StringVar(&c.HTTP.Auth.JWT.Issuer, "auth-jwt-issuer", c.HTTP.Auth.JWT.Issuer, "required iss claim of signed access tokens")
+	fs.StringVar(&c.HTTP.Auth.JWT.Audience, "auth-jwt-audience", c.HTTP.Auth.JWT.Audience, "required aud claim of signed access tokens")
+	fs.DurationVar(&c.HTTP.Auth.JWT.ClockSkew, "auth-jwt-clock-skew", c.HTTP.Auth.JWT.ClockSkew, "tolerated difference between clocks of the gateway and the token issuer")
+
+	fs.StringVar(&c.HTTP.TLS.CertFile, "tls-cert-file", c.HTTP.TLS.CertFile, "PEM `file` with certificate chain, enables HTTPS together with -tls-key-file")
+	fs.StringVar(&c.HTTP.TLS.KeyFile, "tls-key-file", c.HTTP.TLS.KeyFile, "PEM `file` with private key of the certificate")
+	fs.StringVar(&c.HTTP.TLS.MinVersion, "tls-min-version", c.HTTP.TLS.MinVersion, "minimum accepted TLS `version`: 1.0, 1.1 or 1.2")
+	fs.Var((*listValue)(&c.HTTP.TLS.CipherSuites), "tls-cipher-suites", "comma-separated `list` of allowed cipher suites, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	fs.StringVar(&c.HTTP.TLS.RedirectAddr, "tls-redirect-addr", c.HTTP.TLS.RedirectAddr, "`address` of plain HTTP listener redirecting to HTTPS")
+
+	fs.StringVar(&c.Workers.OutboxPath, "workers-outbox-path", c.Workers.OutboxPath, "`file` where pending jobs and dead letters are kept")
+	fs.IntVar(&c.Workers.MaxAttempts, "workers-max-attempts", c.Workers.MaxAttempts, "number of attempts after which a job is dead-lettered")
+	fs.DurationVar(&c.Workers.BaseBackoff, "workers-base-backoff", c.Workers.BaseBackoff, "delay before the first retry of a job")
+	fs.DurationVar(&c.Workers.MaxBackoff, "workers-max-backoff", c.Workers.MaxBackoff, "maximum delay between attempts of a job")
+	fs.StringVar((*string)(&c.Workers.AccountPostPolicy), "workers-account-post-policy", string(c.Workers.AccountPostPolicy), "what happens to posts of a deleted account: delete or anonymize")
+	fs.DurationVar(&c.Workers.ReconcileInterval, "workers-reconcile-interval", c.Workers.ReconcileInterval, "period of the reconciler, 0 disables it")
+	fs.BoolVar(&c.Workers.ReconcileRepair, "workers-reconcile-repair", c.Workers.ReconcileRepair, "make the periodic reconciler repair what it finds")
+	fs.IntVar(&c.Workers.Workers, "workers-per-queue", c.Workers.Workers, "number of workers per queue")
+	fs.Var((*queueWorkersValue)(&c.Workers.QueueWorkers), "workers-queues", "comma-separated `queue=workers` overrides of workers-per-queue")
+	fs.DurationVar(&c.Workers.DrainTimeout, "workers-drain-timeout", c.Workers.DrainTimeout, "how long in-flight jobs may run after shutdown begins")
+
+	backends := c.Backends()
+	for _, name := range backendNames {
+		b := backends[name]
+		fs.StringVar(&b.Addr, name+"-addr", b.Addr, "`address` of the "+name+" service")
+		fs.BoolVar(&b.TLS.Disabled, name+"-tls-disabled", b.TLS.Disabled, "connect to the "+name+" service in plaintext")
+		fs.StringVar(&b.TLS.CAFile, name+"-tls-ca-file", b.TLS.CAFile, "PEM `file` with CA certificates of the "+name+" service")
+		fs.StringVar(&b.TLS.CertFile, name+"-tls-cert-file", b.TLS.CertFile, "PEM `file` with client certificate presented to the "+name+" service")
+		fs.StringVar(&b.TLS.KeyFile, name+"-tls-key-file", b.TLS.KeyFile, "PEM `file` with private key of the client certificate for the "+name+" service")
+		fs.StringVar(&b.TLS.ServerName, name+"-tls-server-name", b.TLS.ServerName, "override of the `name` in the certificate of the "+name+" service")
+		fs.BoolVar(&b.Optional, name+"-optional", b.Optional, "don't report the gateway unready when the "+name+" service is down")
+		fs.BoolVar(&b.HealthCheck, name+"-health-check", b.HealthCheck, "call gRPC health checking service of the "+name+" service from /readyz")
+	}
+
+	fs.Float64Var(&c.Breaker.FailureRate, "breaker-failure-rate", c.Breaker.FailureRate, "share of failed backend calls which opens the circuit breaker, 0 disables breakers")
+	fs.IntVar(&c.Breaker.MinRequests, "breaker-min-requests", c.Breaker.MinRequests, "number of calls within the window needed to open the circuit breaker")
+	fs.DurationVar(&c.Breaker.Window, "breaker-window", c.Breaker.Window, "period over which backend calls are counted")
+	fs.DurationVar(&c.Breaker.OpenTimeout, "breaker-open-timeout", c.Breaker.OpenTimeout, "how long the circuit breaker stays open before probing the backend")
+	fs.IntVar(&c.Breaker.HalfOpenRequests, "breaker-half-open-requests", c.Breaker.HalfOpenRequests, "number of successful probes which close the circuit breaker")
+
+	fs.DurationVar(&c.RPC.Timeout, "rpc-timeout", c.RPC.Timeout, "deadline of a single attempt of a backend call, 0 disables it")
+	fs.Var((*durationMapValue)(&c.RPC.Timeouts), "rpc-timeouts", "comma-separated `method=timeout` overrides of -rpc-timeout, e.g. ListPosts=2s")
+	fs.IntVar(&c.RPC.RetryAttempts, "rpc-retry-attempts", c.RPC.RetryAttempts, "maximum number of attempts of an idempotent backend call")
+	fs.DurationVar(&c.RPC.RetryBaseBackoff, "rpc-retry-base-backoff", c.RPC.RetryBaseBackoff, "delay before the first retry of a backend call")
+	fs.DurationVar(&c.RPC.RetryMaxBackoff, "rpc-retry-max-backoff", c.RPC.RetryMaxBackoff, "maximum delay between attempts of a backend call")
+	fs.Var((*listValue)(&c.RPC.RetryMethods), "rpc-retry-methods", "comma-separated `list` of idempotent backend methods which are retried")
+
+	fs.StringVar(&c.Log.Level, "log-level", c.Log.Level, "minimum `level` of logged messages: debug, info, warning or error")
+	fs.StringVar(&c.Log.Format, "log-format", c.Log.Format, "`format` of log lines: json or text")
+
+	fs.StringVar(&c.JaegerAddr, "jaeger-addr", c.JaegerAddr, "`address` of the Jaeger agent")
+}
+
+// loadEnv applies RSOI_* environment variables to settings
+func loadEnv(settings *flag.FlagSet) error {
+	var err error
+	settings.VisitAll(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+
+		env := envPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if value, ok := os.LookupEnv(env); ok {
+			if setErr := settings.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("%s: %v", env, setErr)
+			}
+		}
+	})
+
+	return err
+}
+
+// loadFile applies the file at path to settings. Nested keys are joined with
+// dashes, so that
+//
+//	post:
+//	  tls:
+//	    ca-file: /post-cert.pem
+//
+// sets -post-tls-ca-file.
+func loadFile(settings *flag.FlagSet, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]interface{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		_, err = toml.Decode(string(data), &values)
+	default:
+		return fmt.Errorf("unsupported file type %q, expected .yaml, .yml or .toml", ext)
+	}
+	if err != nil {
+		return err
+	}
+
+	return applyValues(settings, "", values)
+}
+
+func applyValues(settings *flag.FlagSet, prefix string, values map[string]interface{}) error {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		name := strings.Replace(k, "_", "-", -1)
+		if prefix != "" {
+			name = prefix + "-" + name
+		}
+
+		if settings.Lookup(name) != nil {
+			if err := settings.Set(name, formatValue(values[k])); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			continue
+		}
+
+		section, ok := toMap(values[k])
+		if !ok {
+			return fmt.Errorf("unknown setting %q", name)
+		}
+
+		if err := applyValues(settings, name, section); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// toMap converts a decoded section of the file to a map with string keys
+func toMap(v interface{}) (map[string]interface{}, bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return v, true
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for k, value := range v {
+			result[fmt.Sprint(k)] = value
+		}
+		return result, true
+	}
+
+	return nil, false
+}
+
+// formatValue converts a decoded value of the file to the form accepted by
+// the flag, lists become comma-separated and maps become key=value pairs
+func formatValue(v interface{}) string {
+	if m, ok := toMap(v); ok {
+		pairs := make([]string, 0, len(m))
+		for k, value := range m {
+			pairs = append(pairs, k+"="+formatValue(value))
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ",")
+	}
+
+	if list, ok := v.([]interface{}); ok {
+		items := make([]string, len(list))
+		for i, item := range list {
+			items[i] = formatValue(item)
+		}
+		return strings.Join(items, ",")
+	}
+
+	return fmt.Sprint(v)
+}
+
+// listValue is a comma-separated list flag
+type listValue []string
+
+func (l *listValue) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(s string) error {
+	*l = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+
+	return nil
+}
+
+// queueWorkersValue is a comma-separated list of queue=workers pairs
+type queueWorkersValue map[string]int
+
+func (q *queueWorkersValue) String() string {
+	pairs := make([]string, 0, len(*q))
+	for queue, n := range *q {
+		pairs = append(pairs, queue+"="+strconv.Itoa(n))
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+func (q *queueWorkersValue) Set(s string) error {
+	result := make(map[string]int)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("expected queue=workers, got %q", pair)
+		}
+
+		n, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return fmt.Errorf("number of workers for queue %q: %v", parts[0], err)
+		}
+		result[strings.TrimSpace(parts[0])] = n
+	}
+
+	*q = result
+	return nil
+}
+
+// durationMapValue is a comma-separated list of key=duration pairs
+type durationMapValue map[string]time.Duration
+
+func (d *durationMapValue) String() string {
+	pairs := make([]string, 0, len(*d))
+	for key, t := range *d {
+		pairs = append(pairs, key+"="+t.String())
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+func (d *durationMapValue) Set(s string) error {
+	result := make(map[string]time.Duration)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			return fmt.Errorf("expected key=duration, got %q", pair)
+		}
+
+		t, err := time.ParseDuration(strings.TrimSpace(pair[i+1:]))
+		if err != nil {
+			return err
+		}
+		result[strings.TrimSpace(pair[:i])] = t
+	}
+
+	*d = result
+	return nil
+}
+
+// rateLimitValue is a rate limit policy written as key:limit/period[:burst],
+// empty string disables it
+type rateLimitValue api.RateLimitPolicy
+
+func (p *rateLimitValue) String() string {
+	return api.RateLimitPolicy(*p).String()
+}
+
+func (p *rateLimitValue) Set(s string) error {
+	if s = strings.TrimSpace(s); s == "" {
+		*p = rateLimitValue{}
+		return nil
+	}
+
+	policy, err := api.ParseRateLimitPolicy(s)
+	if err != nil {
+		return err
+	}
+
+	*p = rateLimitValue(policy)
+	return nil
+}
+
+// rateLimitMapValue is a comma-separated list of route=policy pairs
+type rateLimitMapValue map[string]api.RateLimitPolicy
+
+func (m *rateLimitMapValue) String() string {
+	pairs := make([]string, 0, len(*m))
+	for route, p := range *m {
+		pairs = append(pairs, route+"="+p.String())
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+func (m *rateLimitMapValue) Set(s string) error {
+	result := make(map[string]api.RateLimitPolicy)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			return fmt.Errorf("expected route=policy, got %q", pair)
+		}
+
+		p, err := api.ParseRateLimitPolicy(strings.TrimSpace(pair[i+1:]))
+		if err != nil {
+			return err
+		}
+		result[strings.TrimSpace(pair[:i])] = p
+	}
+
+	*m = result
+	return nil
+}